@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rancher/agent/admin"
+)
+
+func newAdminFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	socket := fs.String("admin-socket", envOrDefault("CATTLE_ADMIN_SOCKET", admin.DefaultSocket), "path of the admin socket")
+	return fs, socket
+}
+
+func statusCommand(args []string) error {
+	fs, socket := newAdminFlagSet("status")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Parse(args)
+
+	status, err := admin.NewClient(*socket).Status()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+
+	state := "disconnected"
+	if status.Tunnel.Connected {
+		state = "connected"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Version:\t%s\n", status.Version)
+	fmt.Fprintf(w, "Mode:\t%s\n", status.Mode)
+	fmt.Fprintf(w, "State:\t%s since %s (%s ago)\n", state, status.Tunnel.Since.Format(time.RFC3339), since(status.Tunnel.Since))
+	fmt.Fprintf(w, "Server:\t%s\n", status.Tunnel.URL)
+	if status.Tunnel.SessionID != "" {
+		fmt.Fprintf(w, "Session:\t%s\n", status.Tunnel.SessionID)
+	}
+	if status.Tunnel.DrainingSince != nil {
+		fmt.Fprintf(w, "Draining:\tsince %s (%s ago)\n", status.Tunnel.DrainingSince.Format(time.RFC3339), since(*status.Tunnel.DrainingSince))
+	} else {
+		fmt.Fprintf(w, "Draining:\tno\n")
+	}
+	fmt.Fprintf(w, "Reconnects:\t%d\n", status.Tunnel.Reconnects)
+	fmt.Fprintf(w, "Connections:\t%d\n", status.Tunnel.Connections)
+	if status.Tunnel.LastErrorTime != nil {
+		fmt.Fprintf(w, "Last error:\t%s (%s ago)\n", status.Tunnel.LastError, since(*status.Tunnel.LastErrorTime))
+	}
+	fmt.Fprintf(w, "Log level:\t%s\n", status.LogLevel)
+	return w.Flush()
+}
+
+func reconnectCommand(args []string) error {
+	fs, socket := newAdminFlagSet("reconnect")
+	fs.Parse(args)
+
+	if err := admin.NewClient(*socket).Reconnect(); err != nil {
+		return err
+	}
+	fmt.Println("Reconnect requested")
+	return nil
+}
+
+func drainCommand(args []string) error {
+	fs, socket := newAdminFlagSet("drain")
+	fs.Parse(args)
+
+	status, err := admin.NewClient(*socket).Drain()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Draining, %d connections still open\n", status.Connections)
+	return nil
+}
+
+func resumeCommand(args []string) error {
+	fs, socket := newAdminFlagSet("resume")
+	fs.Parse(args)
+
+	if _, err := admin.NewClient(*socket).Resume(); err != nil {
+		return err
+	}
+	fmt.Println("Resumed, accepting new connections")
+	return nil
+}
+
+func logLevelCommand(args []string) error {
+	fs, socket := newAdminFlagSet("log-level")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s log-level [flags] [debug|info|warning|error]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	client := admin.NewClient(*socket)
+	if fs.NArg() == 0 {
+		level, err := client.LogLevel()
+		if err != nil {
+			return err
+		}
+		fmt.Println(level)
+		return nil
+	}
+
+	level, err := client.SetLogLevel(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Log level set to %s\n", level)
+	return nil
+}
+
+func since(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Second)
+}
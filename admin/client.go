@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rancher/agent/introspect"
+	"github.com/rancher/agent/tunnel"
+)
+
+// Client talks to the admin API of a running agent.
+type Client struct {
+	client *http.Client
+}
+
+// NewClient returns a Client for the agent listening on path.
+func NewClient(path string) *Client {
+	return &Client{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Status() (*Status, error) {
+	status := &Status{}
+	return status, c.do(http.MethodGet, "/v1/status", nil, status)
+}
+
+func (c *Client) Reconnect() error {
+	return c.do(http.MethodPost, "/v1/reconnect", nil, nil)
+}
+
+func (c *Client) Drain() (*tunnel.Status, error) {
+	status := &tunnel.Status{}
+	return status, c.do(http.MethodPost, "/v1/drain", nil, status)
+}
+
+func (c *Client) Resume() (*tunnel.Status, error) {
+	status := &tunnel.Status{}
+	return status, c.do(http.MethodPost, "/v1/resume", nil, status)
+}
+
+// Introspect returns what the agent reports about itself through the tunnel,
+// with up to lines log lines, all of them if 0.
+func (c *Client) Introspect(lines int) (*introspect.Info, error) {
+	info := &introspect.Info{}
+	return info, c.do(http.MethodGet, fmt.Sprintf("/v1/introspect/v1/info?lines=%d", lines), nil, info)
+}
+
+func (c *Client) LogLevel() (string, error) {
+	output := logLevel{}
+	err := c.do(http.MethodGet, "/v1/log-level", nil, &output)
+	return output.Level, err
+}
+
+func (c *Client) SetLogLevel(level string) (string, error) {
+	output := logLevel{}
+	err := c.do(http.MethodPut, "/v1/log-level", logLevel{Level: level}, &output)
+	return output.Level, err
+}
+
+func (c *Client) do(method, path string, input, output interface{}) error {
+	var body bytes.Buffer
+	if input != nil {
+		if err := json.NewEncoder(&body).Encode(input); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://agent"+path, &body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach agent, is it running? %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		errResp := errorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("agent returned %s", resp.Status)
+		}
+		return fmt.Errorf("agent returned %s: %s", resp.Status, errResp.Error)
+	}
+
+	if output != nil {
+		return json.NewDecoder(resp.Body).Decode(output)
+	}
+	return nil
+}
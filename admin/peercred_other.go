@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package admin
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerUID can't tell the peer on this platform, so every connection is
+// refused rather than trusting the socket permissions alone.
+func peerUID(conn net.Conn) (int, error) {
+	return 0, fmt.Errorf("peer credentials are not supported on this platform")
+}
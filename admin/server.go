@@ -0,0 +1,199 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/rancher/agent/logging"
+	"github.com/rancher/agent/tunnel"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultSocket = "/var/run/rancher-agent.sock"
+
+// Status is the state of a running agent.
+type Status struct {
+	Version  string        `json:"version"`
+	Mode     string        `json:"mode"`
+	LogLevel string        `json:"logLevel"`
+	Tunnel   tunnel.Status `json:"tunnel"`
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server serves the admin API on a unix socket only root can connect to.
+type Server struct {
+	Path    string
+	Version string
+	Mode    string
+	Client  *tunnel.Client
+	// Introspect, if set, is served under /v1/introspect/.
+	Introspect http.Handler
+}
+
+// ListenAndServe listens on s.Path and serves the admin API until it fails.
+func (s *Server) ListenAndServe() error {
+	listener, err := listen(s.Path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	logrus.Infof("Serving admin API on %s", s.Path)
+	return http.Serve(&rootListener{Listener: listener}, s.Handler())
+}
+
+// Handler returns the admin API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", s.status)
+	mux.HandleFunc("/v1/reconnect", s.reconnect)
+	mux.HandleFunc("/v1/log-level", s.logLevel)
+	mux.HandleFunc("/v1/drain", s.drain)
+	mux.HandleFunc("/v1/resume", s.resume)
+	if s.Introspect != nil {
+		mux.Handle("/v1/introspect/", http.StripPrefix("/v1/introspect", s.Introspect))
+	}
+	return mux
+}
+
+func (s *Server) status(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, Status{
+		Version:  s.Version,
+		Mode:     s.Mode,
+		LogLevel: logrus.GetLevel().String(),
+		Tunnel:   s.Client.Status(),
+	})
+}
+
+func (s *Server) reconnect(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+		return
+	}
+
+	logrus.Info("Reconnect requested through admin API")
+	s.Client.Reconnect()
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) drain(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+		return
+	}
+
+	logrus.Info("Drain requested through admin API")
+	s.Client.Drain()
+	writeJSON(rw, http.StatusOK, s.Client.Status())
+}
+
+func (s *Server) resume(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+		return
+	}
+
+	logrus.Info("Resume requested through admin API")
+	s.Client.Resume()
+	writeJSON(rw, http.StatusOK, s.Client.Status())
+}
+
+func (s *Server) logLevel(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, logLevel{Level: logrus.GetLevel().String()})
+	case http.MethodPut:
+		input := logLevel{}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		if err := logging.SetLevel(input.Level); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, logLevel{Level: logrus.GetLevel().String()})
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, code int, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(obj)
+}
+
+func writeError(rw http.ResponseWriter, code int, err error) {
+	writeJSON(rw, code, errorResponse{Error: err.Error()})
+}
+
+// listen creates the socket at path, replacing a stale socket left behind by
+// an agent that didn't shut down cleanly.
+func listen(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another agent", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// rootListener drops connections from any user but root, and connections
+// whose user can't be identified.
+type rootListener struct {
+	net.Listener
+}
+
+func (l *rootListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := peerUID(conn)
+		if err != nil {
+			logrus.WithError(err).Warn("Rejecting admin connection, failed to read peer credentials")
+			conn.Close()
+			continue
+		}
+		if uid != 0 {
+			logrus.Warnf("Rejecting admin connection from uid %d", uid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
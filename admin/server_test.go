@@ -0,0 +1,199 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/agent/tunnel"
+	"github.com/sirupsen/logrus"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// accepted dials l, which must be a rootListener, and returns whether it
+// accepted the connection or closed it.
+func accepted(t *testing.T, l net.Listener, network, address string) bool {
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+
+	client, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	select {
+	case conn := <-conns:
+		conn.Close()
+		return true
+	case <-time.After(time.Second):
+	}
+
+	// Refused connections are closed, accepted ones would block.
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("connection was neither accepted nor closed: %v", err)
+	}
+	return false
+}
+
+func TestRootListener(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "admin.sock")
+	listener, err := listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &rootListener{Listener: listener}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket has mode %s", info.Mode())
+	}
+
+	root := os.Getuid() == 0
+	if accepted(t, l, "unix", path) != root {
+		t.Errorf("connection from uid %d accepted: %v", os.Getuid(), !root)
+	}
+}
+
+func TestRootListenerUnidentifiedPeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &rootListener{Listener: listener}
+	defer l.Close()
+
+	if accepted(t, l, "tcp", listener.Addr().String()) {
+		t.Error("a connection without peer credentials was accepted")
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "admin.sock")
+	first, err := listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("listening on a socket in use returned %v", err)
+	}
+
+	// Closing a unix listener removes its socket, leave a stale one behind.
+	first.(*net.UnixListener).SetUnlinkOnClose(false)
+	first.Close()
+	second, err := listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(file); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("listening on a file returned %v", err)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	path := filepath.Join(dir, "admin.sock")
+	listener, err := listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	s := &Server{
+		Version: "v2.0.0",
+		Mode:    "node",
+		Client:  &tunnel.Client{URL: "wss://rancher.test/v3/connect"},
+		Introspect: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			writeJSON(rw, http.StatusOK, map[string]string{"version": req.URL.Path})
+		}),
+	}
+	go http.Serve(listener, s.Handler())
+	client := NewClient(path)
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != "v2.0.0" || status.Mode != "node" || status.Tunnel.Connected {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	tunnelStatus, err := client.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnelStatus.DrainingSince == nil || !s.Client.Draining() {
+		t.Errorf("drain returned %+v", tunnelStatus)
+	}
+	if tunnelStatus, err = client.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if tunnelStatus.DrainingSince != nil || s.Client.Draining() {
+		t.Errorf("resume returned %+v", tunnelStatus)
+	}
+	if err := client.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if level, err := client.SetLogLevel("debug"); err != nil || level != "debug" {
+		t.Errorf("setting the log level returned %q, %v", level, err)
+	}
+	if level, err := client.LogLevel(); err != nil || level != "debug" {
+		t.Errorf("log level is %q, %v", level, err)
+	}
+	if _, err := client.SetLogLevel("loud"); err == nil || !strings.Contains(err.Error(), `400 Bad Request: invalid log level "loud"`) {
+		t.Errorf("setting an invalid log level returned %v", err)
+	}
+
+	if err := client.do(http.MethodGet, "/v1/reconnect", nil, nil); err == nil || !strings.Contains(err.Error(), "405") {
+		t.Errorf("GET /v1/reconnect returned %v", err)
+	}
+	if err := client.do(http.MethodPost, "/v1/status", nil, nil); err == nil || !strings.Contains(err.Error(), "405") {
+		t.Errorf("POST /v1/status returned %v", err)
+	}
+
+	introspected := map[string]string{}
+	if err := client.do(http.MethodGet, "/v1/introspect/v1/info", nil, &introspected); err != nil {
+		t.Fatal(err)
+	}
+	if introspected["version"] != "/v1/info" {
+		t.Errorf("introspect handler got %q", introspected["version"])
+	}
+}
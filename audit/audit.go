@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/agent/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// Event records a decision about a connection the server opened through the
+// tunnel, or a request made over it.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session,omitempty"`
+	Connection int64     `json:"connection,omitempty"`
+	Proto      string    `json:"proto"`
+	Address    string    `json:"address"`
+	// Target is where the connection actually goes when it was rewritten.
+	Target string `json:"target,omitempty"`
+	// Request is the API request made over the connection, for connections
+	// the agent proxies.
+	Request string `json:"request,omitempty"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+var (
+	lock sync.Mutex
+	out  io.WriteCloser
+)
+
+// SetOutput appends events to the file at path as JSON lines. Without a file
+// events are written to the agent log, allowed ones only at debug level since
+// the server opens connections all the time.
+func SetOutput(path string) error {
+	var file io.WriteCloser
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %v", err)
+		}
+		file = f
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if out != nil {
+		out.Close()
+	}
+	out = file
+	return nil
+}
+
+// Record writes event to the audit log.
+func Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Reason = redact.String(event.Reason)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if out == nil {
+		log(event)
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode audit event")
+		return
+	}
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		logrus.WithError(err).Error("Failed to write audit log")
+		log(event)
+	}
+}
+
+func log(event Event) {
+	decision := "allowed"
+	if !event.Allowed {
+		decision = "denied"
+	}
+
+	entry := logrus.WithFields(logrus.Fields{
+		"audit":      decision,
+		"connection": event.Connection,
+	})
+	if event.Target != "" {
+		entry = entry.WithField("target", event.Target)
+	}
+	if event.Reason != "" {
+		entry = entry.WithField("reason", event.Reason)
+	}
+	logf := entry.Infof
+	if event.Allowed {
+		logf = entry.Debugf
+	}
+	if event.Request != "" {
+		logf("Request %s to %s/%s %s", event.Request, event.Proto, event.Address, decision)
+		return
+	}
+	logf("Connect to %s/%s %s", event.Proto, event.Address, decision)
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// levelHook records the level of the audit entries in the agent log.
+type levelHook struct {
+	lock   sync.Mutex
+	levels []logrus.Level
+}
+
+func (h *levelHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *levelHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data["audit"]; ok {
+		h.lock.Lock()
+		h.levels = append(h.levels, entry.Level)
+		h.lock.Unlock()
+	}
+	return nil
+}
+
+func TestRecordLog(t *testing.T) {
+	hook := &levelHook{}
+	logrus.AddHook(hook)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.DebugLevel)
+
+	if err := SetOutput(""); err != nil {
+		t.Fatal(err)
+	}
+	Record(Event{Proto: "tcp", Address: "127.0.0.1:10250", Allowed: true})
+	Record(Event{Proto: "unix", Address: "/var/run/docker.sock", Request: "POST /containers/create", Reason: "privileged"})
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	if len(hook.levels) != 2 || hook.levels[0] != logrus.DebugLevel || hook.levels[1] != logrus.InfoLevel {
+		t.Errorf("audit entries were logged at %v, expected allowed at debug and denied at info", hook.levels)
+	}
+}
+
+func TestRecordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	if err := SetOutput(path); err != nil {
+		t.Fatal(err)
+	}
+	defer SetOutput("")
+
+	Record(Event{Proto: "tcp", Address: "127.0.0.1:10250", Allowed: true})
+	Record(Event{Proto: "tcp", Address: "10.0.0.1:443", Reason: "refused with X-API-Tunnel-Token: abcdefgh12345678"})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("audit log has mode %s", info.Mode())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 || !events[0].Allowed || events[1].Allowed || events[0].Time.IsZero() {
+		t.Fatalf("audit log has %+v", events)
+	}
+	if events[1].Reason != "refused with X-API-Tunnel-Token: [REDACTED]" {
+		t.Errorf("reason is not redacted: %q", events[1].Reason)
+	}
+}
@@ -0,0 +1,284 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rancher/agent/facts"
+	"github.com/rancher/agent/introspect"
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/runtimes"
+)
+
+const (
+	DefaultMaxFileSize = 10 << 20
+	DefaultMaxSize     = 100 << 20
+	DefaultLogLines    = 1000
+	DefaultTimeout     = 30 * time.Second
+
+	// ManifestName is the last entry of every bundle.
+	ManifestName = "manifest.json"
+)
+
+// Options choose what goes into a bundle and how large it may get.
+type Options struct {
+	// Name is the directory the entries are put in, none if empty.
+	Name    string
+	Version string
+	// Agent is the state of the running agent, AgentError why it couldn't be
+	// read if nil.
+	Agent      *introspect.Info
+	AgentError string
+	// Facts, if set, are collected from the host.
+	Facts *facts.Options
+	// Runtimes are asked for their state over their sockets.
+	Runtimes []runtimes.Runtime
+	Files    []File
+	Commands []Command
+	// KubeLogs adds the logs of the KubeContainers found on a docker API.
+	KubeLogs       bool
+	KubeContainers []string
+	// LogLines bounds the container and journal logs.
+	LogLines int
+	// MaxFileSize bounds each entry and MaxSize all of them, in bytes. Entries
+	// over the limit keep their end, which is the most recent part of logs.
+	MaxFileSize int64
+	MaxSize     int64
+	// Timeout bounds each command and runtime request.
+	Timeout time.Duration
+}
+
+// Manifest lists what was collected, and what failed to be.
+type Manifest struct {
+	Version  string    `json:"version"`
+	Hostname string    `json:"hostname"`
+	Created  time.Time `json:"created"`
+	Entries  []Entry   `json:"entries"`
+}
+
+// Entry is a file in the bundle, or the reason it is missing.
+type Entry struct {
+	Name      string `json:"name"`
+	Source    string `json:"source"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Failed returns the entries that couldn't be collected completely.
+func (m *Manifest) Failed() []Entry {
+	var failed []Entry
+	for _, entry := range m.Entries {
+		if entry.Error != "" {
+			failed = append(failed, entry)
+		}
+	}
+	return failed
+}
+
+type writer struct {
+	opts     Options
+	tar      *tar.Writer
+	manifest *Manifest
+	size     int64
+}
+
+// Write collects everything opts ask for into a gzipped tar on w. Every
+// entry is redacted, failures to collect one are recorded in the manifest.
+func Write(w io.Writer, opts Options) (*Manifest, error) {
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = DefaultMaxFileSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.LogLines <= 0 {
+		opts.LogLines = DefaultLogLines
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.KubeContainers == nil {
+		opts.KubeContainers = KubeContainers
+	}
+
+	hostname, _ := os.Hostname()
+	gz := gzip.NewWriter(w)
+	b := &writer{
+		opts: opts,
+		tar:  tar.NewWriter(gz),
+		manifest: &Manifest{
+			Version:  opts.Version,
+			Hostname: hostname,
+			Created:  time.Now().UTC(),
+		},
+	}
+
+	steps := []func() error{
+		b.agent,
+		b.facts,
+		b.host,
+		b.runtimes,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := b.write(ManifestName, manifest); err != nil {
+		return nil, err
+	}
+	if err := b.tar.Close(); err != nil {
+		return nil, err
+	}
+	return b.manifest, gz.Close()
+}
+
+func (b *writer) agent() error {
+	if b.opts.Agent == nil {
+		b.manifest.Entries = append(b.manifest.Entries, Entry{
+			Name:   "agent/info.json",
+			Source: "admin API",
+			Error:  b.opts.AgentError,
+		})
+		return nil
+	}
+
+	info := *b.opts.Agent
+	logs := info.Logs
+	info.Logs = nil
+	if err := b.addJSON("agent/info.json", "admin API", info, nil); err != nil {
+		return err
+	}
+	return b.add("agent/agent.log", "admin API", []byte(strings.Join(logs, "\n")), nil)
+}
+
+func (b *writer) facts() error {
+	if b.opts.Facts == nil {
+		return nil
+	}
+	source := b.opts.Facts.Dir
+	if source == "" {
+		source = facts.DefaultDir
+	}
+	collected, skipped := facts.Collect(*b.opts.Facts)
+	data, err := json.MarshalIndent(collected, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	var collectErr error
+	if len(skipped) > 0 {
+		var problems []string
+		for _, err := range skipped {
+			problems = append(problems, err.Error())
+		}
+		collectErr = errors.New(strings.Join(problems, "; "))
+	}
+	return b.add("host/facts.json", source, data, collectErr)
+}
+
+// addJSON adds obj as indented JSON, or only err if it is set.
+func (b *writer) addJSON(name, source string, obj interface{}, err error) error {
+	if err != nil {
+		return b.add(name, source, nil, err)
+	}
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.add(name, source, data, nil)
+}
+
+// add redacts data and adds it within the size limits. collectErr is recorded
+// in the manifest, the data is still added if there is any.
+func (b *writer) add(name, source string, data []byte, collectErr error) error {
+	entry := Entry{
+		Name: name,
+		// Commands may carry secrets in their arguments.
+		Source: redact.String(source),
+	}
+	if collectErr != nil {
+		entry.Error = redact.String(collectErr.Error())
+	}
+	defer func() {
+		b.manifest.Entries = append(b.manifest.Entries, entry)
+	}()
+
+	if len(data) == 0 && collectErr != nil {
+		return nil
+	}
+
+	data = []byte(redact.String(string(data)))
+	limit := b.opts.MaxFileSize
+	if remaining := b.opts.MaxSize - b.size; remaining < limit {
+		limit = remaining
+	}
+	if limit <= 0 {
+		entry.Error = fmt.Sprintf("skipped, the bundle reached its size limit of %d bytes", b.opts.MaxSize)
+		return nil
+	}
+	if int64(len(data)) > limit {
+		data = data[int64(len(data))-limit:]
+		entry.Truncated = true
+	}
+
+	entry.Size = int64(len(data))
+	b.size += entry.Size
+	return b.write(name, data)
+}
+
+func (b *writer) write(name string, data []byte) error {
+	err := b.tar.WriteHeader(&tar.Header{
+		Name:    path.Join(b.opts.Name, name),
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.manifest.Created,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(b.tar, bytes.NewReader(data))
+	return err
+}
+
+// tail keeps the last limit bytes written to it, so large logs and command
+// output keep their most recent part without being held in memory whole.
+type tail struct {
+	limit int64
+	data  []byte
+}
+
+func newTail(limit int64) *tail {
+	return &tail{limit: limit}
+}
+
+func (t *tail) Write(p []byte) (int, error) {
+	t.data = append(t.data, p...)
+	if int64(len(t.data)) > 2*t.limit {
+		n := copy(t.data, t.data[int64(len(t.data))-t.limit:])
+		t.data = t.data[:n]
+	}
+	return len(p), nil
+}
+
+func (t *tail) Bytes() []byte {
+	if int64(len(t.data)) > t.limit {
+		return t.data[int64(len(t.data))-t.limit:]
+	}
+	return t.data
+}
@@ -0,0 +1,298 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/agent/introspect"
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/runtimes"
+)
+
+const (
+	testSecret = "s3cr3t-registration-value"
+	testToken  = "token-abcde:0123456789abcdefghij0123456789"
+)
+
+// frame multiplexes data into a docker log frame for stream, 1 is stdout and
+// 2 stderr.
+func frame(stream byte, data string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	return append(header, data...)
+}
+
+// newFakeDocker serves the Docker API the bundle reads on a unix socket in
+// dir: etcd logs are multiplexed, kubelet has a TTY and long logs, and
+// /volumes fails.
+func newFakeDocker(t *testing.T, dir string) (string, func()) {
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	for _, p := range []string{"/version", "/info", "/images/json", "/networks"} {
+		p := p
+		mux.HandleFunc(p, func(rw http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(rw, `{"path": %q}`, p)
+		})
+	}
+	mux.HandleFunc("/volumes", func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, `{"message": "volume store is locked"}`, http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/containers/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`[{"Names": ["/etcd"]}, {"Names": ["/kubelet"]}, {"Names": ["/web"]}]`))
+	})
+	mux.HandleFunc("/containers/etcd/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"Config": {"Tty": false}}`))
+	})
+	mux.HandleFunc("/containers/etcd/logs", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(frame(1, "started etcd\n"))
+		rw.Write(frame(2, "joining with password "+testSecret+"\n"))
+		rw.Write(frame(1, "CATTLE_TOKEN="+testToken+"\n"))
+	})
+	mux.HandleFunc("/containers/kubelet/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"Config": {"Tty": true}}`))
+	})
+	mux.HandleFunc("/containers/kubelet/logs", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(bytes.Repeat([]byte("old line\n"), 1000))
+		rw.Write([]byte("last line\n"))
+	})
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener.Close()
+	server.Listener = l
+	server.Start()
+	return socket, server.Close
+}
+
+// read returns the entries of a bundle by name.
+func read(t *testing.T, data []byte) ([]string, map[string]string) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tar.NewReader(gz)
+
+	var names []string
+	entries := map[string]string{}
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		entries[header.Name] = string(content)
+	}
+	return names, entries
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	socket, stop := newFakeDocker(t, dir)
+	defer stop()
+
+	redact.AddSecret(testSecret)
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("127.0.0.1 localhost\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	manifest, err := Write(&out, Options{
+		Name:    "bundle",
+		Version: "v2.0.0",
+		Agent: &introspect.Info{
+			Version: "v2.0.0",
+			Mode:    "node",
+			Logs:    []string{"connecting", "registering with " + testSecret},
+		},
+		Runtimes: []runtimes.Runtime{{Name: runtimes.Docker, Socket: socket}},
+		Files: []File{
+			{Name: "network/hosts", Path: hosts},
+			{Name: "network/missing", Path: filepath.Join(dir, "missing")},
+		},
+		Commands: []Command{
+			{Name: "host/echo", Args: []string{"echo", "X-API-Tunnel-Token: " + testToken}},
+		},
+		KubeLogs:    true,
+		MaxFileSize: 4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, entries := read(t, out.Bytes())
+	if last := names[len(names)-1]; last != "bundle/"+ManifestName {
+		t.Errorf("last entry is %s, expected the manifest", last)
+	}
+	written := &Manifest{}
+	if err := json.Unmarshal([]byte(entries["bundle/"+ManifestName]), written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Version != "v2.0.0" || len(written.Entries) != len(manifest.Entries) {
+		t.Errorf("written manifest %+v differs from the returned one %+v", written, manifest)
+	}
+
+	for _, name := range names {
+		if strings.Contains(entries[name], testSecret) || strings.Contains(entries[name], testToken) {
+			t.Errorf("%s is not redacted: %s", name, entries[name])
+		}
+	}
+
+	expected := map[string]string{
+		"bundle/agent/agent.log":                 "connecting\nregistering with " + redact.Mask,
+		"bundle/network/hosts":                   "127.0.0.1 localhost\n",
+		"bundle/host/echo":                       "X-API-Tunnel-Token: " + redact.Mask + "\n",
+		"bundle/runtime/docker/version.json":     `{"path": "/version"}`,
+		"bundle/runtime/docker/logs/etcd.log":    "started etcd\njoining with password " + redact.Mask + "\nCATTLE_TOKEN=" + redact.Mask + "\n",
+		"bundle/runtime/docker/containers.json":  `[{"Names": ["/etcd"]}, {"Names": ["/kubelet"]}, {"Names": ["/web"]}]`,
+		"bundle/runtime/docker/info.json":        `{"path": "/info"}`,
+		"bundle/runtime/docker/networks.json":    `{"path": "/networks"}`,
+		"bundle/runtime/docker/images.json":      `{"path": "/images/json"}`,
+		"bundle/runtime/docker/logs/kubelet.log": "",
+		"bundle/agent/info.json":                 "",
+		"bundle/runtime/runtimes.json":           "",
+		"bundle/" + ManifestName:                 "",
+	}
+	for name, content := range expected {
+		got, ok := entries[name]
+		switch {
+		case !ok:
+			t.Errorf("%s is missing from the bundle", name)
+		case content != "" && got != content:
+			t.Errorf("%s is %q, expected %q", name, got, content)
+		}
+	}
+
+	if _, ok := entries["bundle/runtime/docker/logs/web.log"]; ok {
+		t.Error("logs of a container that isn't a Kubernetes component are in the bundle")
+	}
+
+	kubelet := entries["bundle/runtime/docker/logs/kubelet.log"]
+	if len(kubelet) != 4096 || !strings.HasSuffix(kubelet, "old line\nlast line\n") {
+		t.Errorf("kubelet logs should keep their last 4096 bytes, got %d bytes ending %q", len(kubelet), kubelet[len(kubelet)-20:])
+	}
+
+	byName := map[string]Entry{}
+	for _, entry := range manifest.Entries {
+		byName[entry.Name] = entry
+	}
+	if entry := byName["runtime/docker/logs/kubelet.log"]; !entry.Truncated || entry.Size != 4096 {
+		t.Errorf("kubelet logs are not recorded as truncated: %+v", entry)
+	}
+	if entry := byName["network/hosts"]; entry.Source != hosts || entry.Size != int64(len("127.0.0.1 localhost\n")) || entry.Error != "" {
+		t.Errorf("unexpected manifest entry %+v", entry)
+	}
+
+	var failed []string
+	for _, entry := range manifest.Failed() {
+		failed = append(failed, entry.Name)
+		if _, ok := entries["bundle/"+entry.Name]; ok {
+			t.Errorf("failed entry %s is in the bundle", entry.Name)
+		}
+	}
+	if strings.Join(failed, ",") != "network/missing,runtime/docker/volumes.json" {
+		t.Errorf("failed entries are %v", failed)
+	}
+	if entry := byName["runtime/docker/volumes.json"]; !strings.Contains(entry.Error, "volume store is locked") {
+		t.Errorf("volumes error is %q", entry.Error)
+	}
+}
+
+func TestWriteSizeLimits(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var files []File
+	for i := 1; i <= 3; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		data := bytes.Repeat([]byte{byte('0' + i)}, 600)
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, File{Name: fmt.Sprintf("file%d", i), Path: file})
+	}
+
+	var out bytes.Buffer
+	manifest, err := Write(&out, Options{
+		AgentError:  "admin socket not found",
+		Files:       files,
+		MaxFileSize: 500,
+		MaxSize:     800,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries := read(t, out.Bytes())
+	expected := []Entry{
+		{Name: "agent/info.json", Source: "admin API", Error: "admin socket not found"},
+		{Name: "file1", Source: files[0].Path, Size: 500, Truncated: true},
+		{Name: "file2", Source: files[1].Path, Size: 300, Truncated: true},
+		{Name: "file3", Source: files[2].Path, Error: "skipped, the bundle reached its size limit of 800 bytes"},
+	}
+	if len(manifest.Entries) != len(expected) {
+		t.Fatalf("manifest has %+v, expected %+v", manifest.Entries, expected)
+	}
+	for i, entry := range manifest.Entries {
+		if entry != expected[i] {
+			t.Errorf("manifest entry %d is %+v, expected %+v", i, entry, expected[i])
+		}
+	}
+	if entries["file1"] != strings.Repeat("1", 500) || entries["file2"] != strings.Repeat("2", 300) {
+		t.Errorf("truncated entries are %q and %q", entries["file1"], entries["file2"])
+	}
+	if _, ok := entries["file3"]; ok {
+		t.Error("file3 is in the bundle although it is over the size limit")
+	}
+}
+
+func TestDemuxerSplitFrames(t *testing.T) {
+	stream := append(frame(1, "out\n"), frame(2, "")...)
+	stream = append(stream, frame(2, "err\n")...)
+	stream = append(stream, frame(1, "partial line")[:12]...)
+
+	var out bytes.Buffer
+	d := &demuxer{out: &out}
+	for i := range stream {
+		if _, err := d.Write(stream[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "out\nerr\npart" {
+		t.Errorf("demuxed %q", out.String())
+	}
+}
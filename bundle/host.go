@@ -0,0 +1,106 @@
+package bundle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// File is a host file copied into the bundle.
+type File struct {
+	Name string
+	Path string
+}
+
+// Command is a host command whose output is added to the bundle.
+type Command struct {
+	Name string
+	Args []string
+}
+
+func (c Command) String() string {
+	return strings.Join(c.Args, " ")
+}
+
+// DefaultFiles describe the host and its network configuration.
+var DefaultFiles = []File{
+	{Name: "host/os-release", Path: "/etc/os-release"},
+	{Name: "host/version", Path: "/proc/version"},
+	{Name: "host/cmdline", Path: "/proc/cmdline"},
+	{Name: "host/meminfo", Path: "/proc/meminfo"},
+	{Name: "host/loadavg", Path: "/proc/loadavg"},
+	{Name: "host/mounts", Path: "/proc/mounts"},
+	{Name: "network/resolv.conf", Path: "/etc/resolv.conf"},
+	{Name: "network/hosts", Path: "/etc/hosts"},
+	{Name: "network/route", Path: "/proc/net/route"},
+	{Name: "network/ipv6_route", Path: "/proc/net/ipv6_route"},
+}
+
+// DefaultCommands gather kernel messages, the agent journal and the routing
+// and firewall state. Commands missing on the host are recorded as failed.
+func DefaultCommands(unit string, logLines int) []Command {
+	if logLines <= 0 {
+		logLines = DefaultLogLines
+	}
+	return []Command{
+		{Name: "host/uname", Args: []string{"uname", "-a"}},
+		{Name: "host/df", Args: []string{"df", "-h"}},
+		{Name: "host/dmesg", Args: []string{"dmesg"}},
+		{Name: "host/journal", Args: []string{"journalctl", "--no-pager", "-u", unit, "-n", fmt.Sprint(logLines)}},
+		{Name: "network/addresses", Args: []string{"ip", "addr", "show"}},
+		{Name: "network/links", Args: []string{"ip", "-d", "link", "show"}},
+		{Name: "network/routes", Args: []string{"ip", "route", "show", "table", "all"}},
+		{Name: "network/ipv6-routes", Args: []string{"ip", "-6", "route", "show", "table", "all"}},
+		{Name: "network/rules", Args: []string{"ip", "rule", "show"}},
+		{Name: "network/iptables", Args: []string{"iptables-save"}},
+		{Name: "network/ip6tables", Args: []string{"ip6tables-save"}},
+		{Name: "network/sockets", Args: []string{"ss", "-tunap"}},
+	}
+}
+
+func (b *writer) host() error {
+	for _, file := range b.opts.Files {
+		data, readErr := b.readFile(file.Path)
+		if err := b.add(file.Name, file.Path, data, readErr); err != nil {
+			return err
+		}
+	}
+	for _, command := range b.opts.Commands {
+		data, runErr := b.run(command.Args)
+		if err := b.add(command.Name, command.String(), data, runErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *writer) readFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Keep one more byte than fits so add sees the entry is truncated.
+	out := newTail(b.opts.MaxFileSize + 1)
+	_, err = io.Copy(out, f)
+	return out.Bytes(), err
+}
+
+// run returns the combined output of args, along with any error running it.
+func (b *writer) run(args []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.opts.Timeout)
+	defer cancel()
+
+	out := newTail(b.opts.MaxFileSize + 1)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return out.Bytes(), fmt.Errorf("timed out after %s", b.opts.Timeout)
+	}
+	return out.Bytes(), err
+}
@@ -0,0 +1,232 @@
+package bundle
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rancher/agent/runtimes"
+)
+
+// KubeContainers are the containers RKE runs the Kubernetes components in.
+var KubeContainers = []string{
+	"etcd",
+	"kube-apiserver",
+	"kube-controller-manager",
+	"kube-scheduler",
+	"kubelet",
+	"kube-proxy",
+	"nginx-proxy",
+}
+
+var dockerPaths = []struct {
+	name string
+	path string
+}{
+	{"version.json", "/version"},
+	{"info.json", "/info"},
+	{"containers.json", "/containers/json?all=1"},
+	{"images.json", "/images/json"},
+	{"networks.json", "/networks"},
+	{"volumes.json", "/volumes"},
+}
+
+func (b *writer) runtimes() error {
+	if len(b.opts.Runtimes) == 0 {
+		return nil
+	}
+	if err := b.addJSON("runtime/runtimes.json", "discovery", b.opts.Runtimes, nil); err != nil {
+		return err
+	}
+
+	seen := map[string]int{}
+	for _, runtime := range b.opts.Runtimes {
+		seen[runtime.Name]++
+		dir := "runtime/" + runtime.Name
+		if n := seen[runtime.Name]; n > 1 {
+			dir = fmt.Sprintf("%s-%d", dir, n)
+		}
+
+		var err error
+		switch {
+		case runtime.DockerAPI():
+			err = b.dockerAPI(dir, runtime.Socket)
+		case runtime.Name == runtimes.CRIO:
+			data, getErr := b.get(runtime.Socket, "/info")
+			err = b.add(dir+"/info.json", runtime.Socket+" GET /info", data, getErr)
+		case runtime.Name == runtimes.Containerd:
+			err = b.containerd(dir, runtime.Socket)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *writer) dockerAPI(dir, socket string) error {
+	var containers []byte
+	for _, p := range dockerPaths {
+		data, getErr := b.get(socket, p.path)
+		if err := b.add(dir+"/"+p.name, socket+" GET "+p.path, data, getErr); err != nil {
+			return err
+		}
+		if p.name == "containers.json" && getErr == nil {
+			containers = data
+		}
+	}
+
+	if !b.opts.KubeLogs || containers == nil {
+		return nil
+	}
+	for _, name := range kubeContainers(containers, b.opts.KubeContainers) {
+		data, logsErr := b.containerLogs(socket, name)
+		source := fmt.Sprintf("%s logs of container %s", socket, name)
+		if err := b.add(dir+"/logs/"+name+".log", source, data, logsErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kubeContainers returns the wanted containers that are in the docker
+// container list.
+func kubeContainers(list []byte, wanted []string) []string {
+	var containers []struct {
+		Names []string
+	}
+	if err := json.Unmarshal(list, &containers); err != nil {
+		return nil
+	}
+
+	present := map[string]bool{}
+	for _, container := range containers {
+		for _, name := range container.Names {
+			present[strings.TrimPrefix(name, "/")] = true
+		}
+	}
+
+	var found []string
+	for _, name := range wanted {
+		if present[name] {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+func (b *writer) containerLogs(socket, name string) ([]byte, error) {
+	data, err := b.get(socket, "/containers/"+url.PathEscape(name)+"/json")
+	if err != nil {
+		return nil, err
+	}
+	inspect := struct {
+		Config struct {
+			Tty bool
+		}
+	}{}
+	if err := json.Unmarshal(data, &inspect); err != nil {
+		return nil, fmt.Errorf("failed to parse container %s: %v", name, err)
+	}
+
+	path := fmt.Sprintf("/containers/%s/logs?stdout=1&stderr=1&timestamps=1&tail=%d", url.PathEscape(name), b.opts.LogLines)
+	if inspect.Config.Tty {
+		return b.get(socket, path)
+	}
+	return b.stream(socket, path, func(out io.Writer) io.Writer {
+		return &demuxer{out: out}
+	})
+}
+
+// demuxer joins the stdout and stderr frames docker multiplexes the logs of
+// containers without a TTY into. A partial last frame is kept as is.
+type demuxer struct {
+	out       io.Writer
+	header    [8]byte
+	read      int
+	remaining int
+}
+
+func (d *demuxer) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if d.remaining == 0 {
+			n := copy(d.header[d.read:], p)
+			d.read += n
+			p = p[n:]
+			if d.read == len(d.header) {
+				d.remaining = int(binary.BigEndian.Uint32(d.header[4:8]))
+				d.read = 0
+			}
+			continue
+		}
+
+		n := d.remaining
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := d.out.Write(p[:n]); err != nil {
+			return 0, err
+		}
+		d.remaining -= n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (b *writer) containerd(dir, socket string) error {
+	commands := []Command{
+		{Name: dir + "/version", Args: []string{"ctr", "--address", socket, "version"}},
+		{Name: dir + "/namespaces", Args: []string{"ctr", "--address", socket, "namespaces", "list"}},
+		{Name: dir + "/containers", Args: []string{"ctr", "--address", socket, "--namespace", "k8s.io", "containers", "list"}},
+	}
+	for _, command := range commands {
+		data, runErr := b.run(command.Args)
+		if err := b.add(command.Name, command.String(), data, runErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get reads path from the HTTP API on socket, keeping the end of the body up
+// to one byte more than an entry may hold.
+func (b *writer) get(socket, path string) ([]byte, error) {
+	return b.stream(socket, path, nil)
+}
+
+// stream is get with the body written through the writer filter returns, if
+// filter is set.
+func (b *writer) stream(socket, path string, filter func(io.Writer) io.Writer) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runtimes.HTTPClient(socket).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, b.opts.MaxFileSize+1))
+		return nil, fmt.Errorf("GET %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	out := newTail(b.opts.MaxFileSize + 1)
+	var w io.Writer = out
+	if filter != nil {
+		w = filter(out)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return out.Bytes(), err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rancher/agent/cleanup"
+	"github.com/rancher/agent/runtimes"
+)
+
+func cleanupCommand(args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	socket := fs.String("socket", "", "docker API to remove containers and volumes through, the first one found if empty")
+	dryRun := fs.Bool("dry-run", false, "list what would be removed without removing anything")
+	yes := fs.Bool("yes", false, "remove without asking for confirmation")
+	timeout := fs.Duration("timeout", cleanup.DefaultTimeout, "timeout for each docker API request and command")
+	categories := map[string]*bool{
+		cleanup.Containers:  fs.Bool(cleanup.Containers, true, "remove RKE and pod containers"),
+		cleanup.Volumes:     fs.Bool(cleanup.Volumes, true, "remove the volumes of the removed containers"),
+		cleanup.Directories: fs.Bool(cleanup.Directories, true, "unmount and remove /etc/kubernetes, /var/lib/etcd and the other Kubernetes and CNI directories"),
+		cleanup.Interfaces:  fs.Bool(cleanup.Interfaces, true, "delete the network interfaces of the CNI plugins"),
+		cleanup.Iptables:    fs.Bool(cleanup.Iptables, true, "delete the iptables chains of kube-proxy and the CNI plugins"),
+	}
+	fs.Parse(args)
+
+	opts := cleanup.Options{
+		Socket:  *socket,
+		Timeout: *timeout,
+		Out:     os.Stdout,
+	}
+	for _, category := range cleanup.Categories {
+		if *categories[category] {
+			opts.Categories = append(opts.Categories, category)
+		}
+	}
+	if len(opts.Categories) == 0 {
+		return fmt.Errorf("nothing to clean up, every category is disabled")
+	}
+	if opts.Socket == "" {
+		for _, runtime := range runtimes.Discover(runtimes.DefaultTimeout) {
+			if runtime.DockerAPI() && runtime.Error == "" {
+				opts.Socket = runtime.Socket
+				break
+			}
+		}
+	}
+	// The container running this must not be removed while it does.
+	opts.Self = cleanup.SelfContainerID()
+
+	actions, err := cleanup.Plan(opts)
+	if err != nil {
+		return err
+	}
+	if len(actions) == 0 {
+		fmt.Println("Nothing to clean up")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, action := range actions {
+		fmt.Fprintf(w, "%s\t%s\n", action.Category, action.Target)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, %d items would be removed\n", len(actions))
+		return nil
+	}
+
+	if !*yes {
+		fmt.Printf("Remove the %d items above? This can't be undone. Type yes to continue: ", len(actions))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			return fmt.Errorf("cleanup aborted, nothing was removed")
+		}
+	}
+
+	if err := cleanup.Apply(opts, actions); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d items\n", len(actions))
+	return nil
+}
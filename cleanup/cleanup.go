@@ -0,0 +1,159 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Categories of what cleanup removes.
+const (
+	Containers  = "containers"
+	Volumes     = "volumes"
+	Directories = "directories"
+	Interfaces  = "interfaces"
+	Iptables    = "iptables"
+
+	DefaultTimeout = 30 * time.Second
+)
+
+// Categories are everything cleanup can remove, in the order it is removed.
+var Categories = []string{Containers, Volumes, Directories, Interfaces, Iptables}
+
+// Options choose what is cleaned up and how.
+type Options struct {
+	// Categories to clean up, all of them if empty.
+	Categories []string
+	// Socket is the docker API containers and volumes are removed through.
+	Socket string
+	// Self is the ID, or its 12 character prefix, of a container that is
+	// never removed, the one the agent runs in.
+	Self string
+	// Directories to remove, DefaultDirectories if nil.
+	Directories []string
+	// Mounts is the mount table read to unmount within Directories,
+	// /proc/self/mounts if empty.
+	Mounts string
+	// Run runs a command and returns its combined output, nil runs it with
+	// a Timeout.
+	Run     func(args ...string) ([]byte, error)
+	Timeout time.Duration
+	// Out receives a line per action taken.
+	Out io.Writer
+}
+
+func (o *Options) defaults() {
+	if len(o.Categories) == 0 {
+		o.Categories = Categories
+	}
+	if o.Directories == nil {
+		o.Directories = DefaultDirectories
+	}
+	if o.Mounts == "" {
+		o.Mounts = "/proc/self/mounts"
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Run == nil {
+		o.Run = o.run
+	}
+	if o.Out == nil {
+		o.Out = ioutil.Discard
+	}
+}
+
+func (o *Options) enabled(category string) bool {
+	for _, c := range o.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Options) run(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if ctx.Err() != nil {
+		return output, fmt.Errorf("%s timed out after %s", args[0], o.Timeout)
+	}
+	if err != nil {
+		return output, fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// Action is one thing cleanup removes.
+type Action struct {
+	Category string `json:"category"`
+	Target   string `json:"target"`
+	Error    string `json:"error,omitempty"`
+
+	apply func() error
+}
+
+func (a Action) String() string {
+	return a.Category + " " + a.Target
+}
+
+// Plan lists what cleanup would remove, without changing anything.
+func Plan(opts Options) ([]Action, error) {
+	opts.defaults()
+
+	var actions []Action
+	if opts.enabled(Containers) || opts.enabled(Volumes) {
+		found, err := planContainers(&opts)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, found...)
+	}
+	if opts.enabled(Directories) {
+		found, err := planDirectories(&opts)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, found...)
+	}
+	if opts.enabled(Interfaces) {
+		found, err := planInterfaces(&opts)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, found...)
+	}
+	if opts.enabled(Iptables) {
+		actions = append(actions, planIptables(&opts)...)
+	}
+	return actions, nil
+}
+
+// Apply takes the planned actions in order. It goes on after failures, which
+// are recorded in the actions, and returns an error if there were any.
+func Apply(opts Options, actions []Action) error {
+	opts.defaults()
+
+	failed := 0
+	for i := range actions {
+		action := &actions[i]
+		if err := action.apply(); err != nil {
+			failed++
+			action.Error = err.Error()
+			fmt.Fprintf(opts.Out, "failed to remove %s: %v\n", action, err)
+			continue
+		}
+		fmt.Fprintf(opts.Out, "removed %s\n", action)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d removals failed", failed, len(actions))
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package cleanup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testID = "3f4e8a1b2c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f7"
+
+func TestCgroupContainerID(t *testing.T) {
+	for _, test := range []struct {
+		cgroup, expected string
+	}{
+		{"12:pids:/docker/" + testID + "\n1:name=systemd:/docker/" + testID + "\n", testID},
+		{"0::/system.slice/docker-" + testID + ".scope\n", testID},
+		{"11:memory:/kubepods/besteffort/pod1234/" + testID + "\n", testID},
+		{"0::/\n", ""},
+		{"12:pids:/user.slice\n0::/user.slice/user-1000.slice/session-2.scope\n", ""},
+	} {
+		if id := cgroupContainerID(test.cgroup); id != test.expected {
+			t.Errorf("%q: got %q, expected %q", test.cgroup, id, test.expected)
+		}
+	}
+}
+
+func TestMountinfoContainerID(t *testing.T) {
+	layer := "d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2"
+	mountinfo := "" +
+		"611 530 0:52 / / rw,relatime - overlay overlay rw,lowerdir=/var/lib/docker/overlay2/l/ABC,upperdir=/var/lib/docker/overlay2/" + layer + "/diff\n" +
+		"640 611 8:1 /var/lib/docker/containers/" + testID + "/resolv.conf /etc/resolv.conf rw,relatime - ext4 /dev/sda1 rw\n" +
+		"641 611 8:1 /var/lib/docker/containers/" + testID + "/hostname /etc/hostname rw,relatime - ext4 /dev/sda1 rw\n"
+	if id := mountinfoContainerID(mountinfo); id != testID {
+		t.Errorf("got %q, expected %q", id, testID)
+	}
+	if id := mountinfoContainerID("611 530 0:52 / / rw - overlay overlay rw,upperdir=/var/lib/docker/overlay2/" + layer + "/diff\n"); id != "" {
+		t.Errorf("found %q in the mounts of a process outside a container", id)
+	}
+}
+
+func TestCNIInterface(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { sysClassNet = old }(sysClassNet)
+	sysClassNet = dir
+
+	for iface, bridge := range map[string]string{
+		"veth1a2b3c":    "cni0",
+		"veth4d5e6f":    "docker0",
+		"vethwe-bridge": "weave",
+		"veth7a8b9c":    "",
+	} {
+		if err := os.Mkdir(filepath.Join(dir, iface), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if bridge != "" {
+			if err := os.Symlink("../"+bridge, filepath.Join(dir, iface, "master")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for name, expected := range map[string]bool{
+		"cni0":          true,
+		"flannel.1":     true,
+		"cali12345":     true,
+		"veth1a2b3c":    true,
+		"vethwe-bridge": true,
+		"veth4d5e6f":    false,
+		"veth7a8b9c":    false,
+		"docker0":       false,
+		"eth0":          false,
+	} {
+		if cniInterface(name) != expected {
+			t.Errorf("%s: cniInterface should be %v", name, expected)
+		}
+	}
+}
+
+func TestRancherContainer(t *testing.T) {
+	for _, test := range []struct {
+		name, image string
+		expected    bool
+	}{
+		{"/kubelet", "rancher/hyperkube:v1.20.4-rancher1", true},
+		{"/etcd", "quay.io/coreos/etcd:v3.4.3", true},
+		{"/k8s_POD_coredns-7c5566588d-abcde_kube-system_1234_0", "rancher/pause:3.2", true},
+		{"/rke-etcd-port-listener", "rancher/rke-tools:v0.1.72", true},
+		// Rancher images run by anything but RKE are left alone, such as
+		// the Rancher server and the agent itself.
+		{"/rancher", "rancher/rancher:v2.5.7", false},
+		{"/upbeat_hopper", "rancher/rancher-agent:v2.5.7", false},
+		{"/registry", "registry.test/rancher/rancher:v2.5.7", false},
+		{"/web", "nginx", false},
+	} {
+		c := container{Names: []string{test.name}, Image: test.image}
+		if c.rancher() != test.expected {
+			t.Errorf("%s (%s): rancher should be %v", test.name, test.image, test.expected)
+		}
+	}
+}
+
+func TestSplitRule(t *testing.T) {
+	for _, test := range []struct {
+		rule     string
+		expected []string
+	}{
+		{`PREROUTING -j KUBE-SERVICES`, []string{"PREROUTING", "-j", "KUBE-SERVICES"}},
+		{
+			`PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES`,
+			[]string{"PREROUTING", "-m", "comment", "--comment", "kubernetes service portals", "-j", "KUBE-SERVICES"},
+		},
+		{
+			`FORWARD -m comment --comment "a \"quoted\" name" -j CNI-FORWARD`,
+			[]string{"FORWARD", "-m", "comment", "--comment", `a "quoted" name`, "-j", "CNI-FORWARD"},
+		},
+		{`INPUT --comment "" -j ACCEPT`, []string{"INPUT", "--comment", "", "-j", "ACCEPT"}},
+		{`INPUT  -s 10.0.0.0/8   -j ACCEPT `, []string{"INPUT", "-s", "10.0.0.0/8", "-j", "ACCEPT"}},
+	} {
+		args := splitRule(test.rule)
+		if strings.Join(args, "|") != strings.Join(test.expected, "|") || len(args) != len(test.expected) {
+			t.Errorf("%s: split into %q, expected %q", test.rule, args, test.expected)
+		}
+	}
+}
+
+func TestPlanTable(t *testing.T) {
+	save := `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+:KUBE-SERVICES - [0:0]
+:CNI-3f4e8a1b2c5d6e7f8091a2b3 - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
+-A POSTROUTING -s 10.42.0.5/32 -m comment --comment "name: \"k8s-pod-network\" id: \"abc\"" -j CNI-3f4e8a1b2c5d6e7f8091a2b3
+-A KUBE-SERVICES -j KUBE-NODEPORTS
+COMMIT
+`
+	var calls []string
+	opts := &Options{Run: func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, "|"))
+		return nil, nil
+	}}
+	for _, action := range planTable(opts, "iptables", "nat", save) {
+		if action.Category != Iptables {
+			t.Errorf("%s has category %s", action.Target, action.Category)
+		}
+		if err := action.apply(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Jumps into the chains go first, they can't be removed while used.
+	expected := []string{
+		"iptables|-t|nat|-D|PREROUTING|-m|comment|--comment|kubernetes service portals|-j|KUBE-SERVICES",
+		`iptables|-t|nat|-D|POSTROUTING|-s|10.42.0.5/32|-m|comment|--comment|name: "k8s-pod-network" id: "abc"|-j|CNI-3f4e8a1b2c5d6e7f8091a2b3`,
+		"iptables|-t|nat|-F|KUBE-SERVICES",
+		"iptables|-t|nat|-F|CNI-3f4e8a1b2c5d6e7f8091a2b3",
+		"iptables|-t|nat|-X|KUBE-SERVICES",
+		"iptables|-t|nat|-X|CNI-3f4e8a1b2c5d6e7f8091a2b3",
+	}
+	if strings.Join(calls, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("ran\n%s\nexpected\n%s", strings.Join(calls, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestWithin(t *testing.T) {
+	mounts := []string{
+		"/var/lib/kubelet",
+		"/var/lib/kubelet/pods/1234/volumes/kubernetes.io~secret/token",
+		"/var/lib/kubeletx",
+		"/var/lib/kubelet/pods/1234/volumes/kubernetes.io~secret/token",
+		"/var/lib/kubelet/pods/1234",
+		"/var/lib",
+	}
+	// Mounts below others are unmounted first.
+	expected := []string{
+		"/var/lib/kubelet/pods/1234/volumes/kubernetes.io~secret/token",
+		"/var/lib/kubelet/pods/1234",
+		"/var/lib/kubelet",
+	}
+	if found := within(mounts, "/var/lib/kubelet/"); strings.Join(found, ",") != strings.Join(expected, ",") {
+		t.Errorf("found %q, expected %q", found, expected)
+	}
+	if found := within(mounts, "/opt/rke"); len(found) != 0 {
+		t.Errorf("found %q in a directory without mounts", found)
+	}
+}
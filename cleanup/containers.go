@@ -0,0 +1,214 @@
+package cleanup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rancher/agent/runtimes"
+)
+
+// rkeContainers are the containers RKE runs on nodes, whatever their image.
+var rkeContainers = map[string]bool{
+	"etcd":                    true,
+	"etcd-rolling-snapshots":  true,
+	"kube-apiserver":          true,
+	"kube-controller-manager": true,
+	"kube-scheduler":          true,
+	"kubelet":                 true,
+	"kube-proxy":              true,
+	"nginx-proxy":             true,
+	"service-sidekick":        true,
+	"share-mnt":               true,
+	"rke-bundle-cert":         true,
+	"cert-deployer":           true,
+}
+
+type container struct {
+	ID     string `json:"Id"`
+	Names  []string
+	Image  string
+	Mounts []struct {
+		Type string
+		Name string
+	}
+}
+
+func (c container) name() string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// rancher returns whether RKE created the container: it is an RKE component
+// or a pod container of the kubelet. The image is no help, a rancher image
+// may run anything, such as the Rancher server itself.
+func (c container) rancher() bool {
+	for _, name := range c.Names {
+		name = strings.TrimPrefix(name, "/")
+		if rkeContainers[name] || strings.HasPrefix(name, "k8s_") || strings.HasPrefix(name, "rke-") {
+			return true
+		}
+	}
+	return false
+}
+
+func planContainers(opts *Options) ([]Action, error) {
+	if opts.Socket == "" {
+		return nil, fmt.Errorf("no docker API found to remove %s and %s through, set the socket or leave them out", Containers, Volumes)
+	}
+
+	var containers []container
+	if err := dockerAPI(opts, http.MethodGet, "/containers/json?all=1", &containers); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	var actions []Action
+	volumes := map[string]bool{}
+	for _, c := range containers {
+		if !c.rancher() || isSelf(c.ID, opts.Self) {
+			continue
+		}
+		for _, mount := range c.Mounts {
+			if mount.Type == "volume" && mount.Name != "" {
+				volumes[mount.Name] = true
+			}
+		}
+		if !opts.enabled(Containers) {
+			continue
+		}
+
+		path := fmt.Sprintf("/containers/%s?force=1&v=%t", url.PathEscape(c.ID), opts.enabled(Volumes))
+		actions = append(actions, Action{
+			Category: Containers,
+			Target:   fmt.Sprintf("%s (%s)", c.name(), c.Image),
+			apply: func() error {
+				return dockerAPI(opts, http.MethodDelete, path, nil)
+			},
+		})
+	}
+
+	if !opts.enabled(Volumes) {
+		return actions, nil
+	}
+	// Anonymous volumes go with their containers, named ones are removed
+	// after all the containers using them are.
+	var names []string
+	for name := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := "/volumes/" + url.PathEscape(name)
+		actions = append(actions, Action{
+			Category: Volumes,
+			Target:   name,
+			apply: func() error {
+				return dockerAPI(opts, http.MethodDelete, path, nil)
+			},
+		})
+	}
+	return actions, nil
+}
+
+func isSelf(id, self string) bool {
+	return self != "" && len(self) >= 12 && strings.HasPrefix(id, self)
+}
+
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// SelfContainerID returns the ID of the docker container this process runs
+// in, or an empty string if it isn't found. The hostname is no help, it is
+// the host's with --net=host.
+func SelfContainerID() string {
+	if data, err := ioutil.ReadFile("/proc/self/cgroup"); err == nil {
+		if id := cgroupContainerID(string(data)); id != "" {
+			return id
+		}
+	}
+	// With cgroup v2 and a private cgroup namespace the cgroup is only /, but
+	// docker bind mounts the container's hostname, hosts and resolv.conf.
+	if data, err := ioutil.ReadFile("/proc/self/mountinfo"); err == nil {
+		return mountinfoContainerID(string(data))
+	}
+	return ""
+}
+
+// cgroupContainerID finds the container ID in cgroup paths such as
+// /docker/<id> or /system.slice/docker-<id>.scope.
+func cgroupContainerID(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if ids := containerID.FindAllString(parts[2], -1); len(ids) > 0 {
+			return ids[len(ids)-1]
+		}
+	}
+	return ""
+}
+
+// mountinfoContainerID finds the container ID in the source of the files
+// docker mounts into /etc, .../containers/<id>/hostname.
+func mountinfoContainerID(mountinfo string) string {
+	for _, line := range strings.Split(mountinfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		switch fields[4] {
+		case "/etc/hostname", "/etc/hosts", "/etc/resolv.conf":
+		default:
+			continue
+		}
+		parts := strings.Split(fields[3], "/")
+		for i := 0; i < len(parts)-1; i++ {
+			if parts[i] == "containers" && containerID.MatchString(parts[i+1]) && len(parts[i+1]) == 64 {
+				return parts[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+func dockerAPI(opts *Options, method, path string, into interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(method, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := runtimes.HTTPClient(opts.Socket).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodDelete {
+		// Already gone, as anonymous volumes are with their container.
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		message := struct {
+			Message string `json:"message"`
+		}{}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(body, &message) != nil || message.Message == "" {
+			message.Message = strings.TrimSpace(string(body))
+		}
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, message.Message)
+	}
+	if into == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
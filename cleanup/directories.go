@@ -0,0 +1,121 @@
+package cleanup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultDirectories are where RKE and the network plugins keep their state.
+// The agent state directory is left alone, uninstall --purge removes it.
+var DefaultDirectories = []string{
+	"/etc/ceph",
+	"/etc/cni",
+	"/etc/kubernetes",
+	"/opt/cni",
+	"/opt/rke",
+	"/run/calico",
+	"/run/flannel",
+	"/run/secrets/kubernetes.io",
+	"/var/lib/calico",
+	"/var/lib/cni",
+	"/var/lib/etcd",
+	"/var/lib/kubelet",
+	"/var/lib/rancher/rke",
+	"/var/log/containers",
+	"/var/log/kube-audit",
+	"/var/log/pods",
+	"/var/run/calico",
+}
+
+func planDirectories(opts *Options) ([]Action, error) {
+	mounts, err := readMounts(opts.Mounts)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []Action
+	for _, dir := range opts.Directories {
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Pods leave volumes mounted in the kubelet directory, unmount them
+		// deepest first so removing it can't reach into what they mount.
+		for _, mount := range within(mounts, dir) {
+			mount := mount
+			actions = append(actions, Action{
+				Category: Directories,
+				Target:   "unmount " + mount,
+				apply: func() error {
+					_, err := opts.Run("umount", "-l", mount)
+					return err
+				},
+			})
+		}
+
+		dir := dir
+		actions = append(actions, Action{
+			Category: Directories,
+			Target:   dir,
+			apply: func() error {
+				mounts, err := readMounts(opts.Mounts)
+				if err != nil {
+					return err
+				}
+				if left := within(mounts, dir); len(left) > 0 {
+					return fmt.Errorf("still mounted: %s", strings.Join(left, ", "))
+				}
+				return os.RemoveAll(dir)
+			},
+		})
+	}
+	return actions, nil
+}
+
+// readMounts returns the mount points in the mount table at path.
+func readMounts(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %v", err)
+	}
+
+	var mounts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mounts = append(mounts, unescapeMount(fields[1]))
+	}
+	return mounts, nil
+}
+
+// unescapeMount decodes the octal escapes the kernel writes for spaces, tabs,
+// newlines and backslashes in mount points.
+func unescapeMount(s string) string {
+	replacer := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	return replacer.Replace(s)
+}
+
+// within returns the mount points in or at dir, deepest first.
+func within(mounts []string, dir string) []string {
+	dir = filepath.Clean(dir)
+	seen := map[string]bool{}
+	var found []string
+	for _, mount := range mounts {
+		if (mount == dir || strings.HasPrefix(mount, dir+"/")) && !seen[mount] {
+			seen[mount] = true
+			found = append(found, mount)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return strings.Count(found[i], "/") > strings.Count(found[j], "/")
+	})
+	return found
+}
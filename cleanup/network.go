@@ -0,0 +1,207 @@
+package cleanup
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// interfaceNames and interfacePrefixes match the interfaces the network
+// plugins RKE deploys create.
+var (
+	interfaceNames = map[string]bool{
+		"cni0":            true,
+		"datapath":        true,
+		"flannel.1":       true,
+		"flannel-v6.1":    true,
+		"flannel-wg":      true,
+		"kube-ipvs0":      true,
+		"nodelocaldns":    true,
+		"tunl0":           true,
+		"vxlan.calico":    true,
+		"vxlan-v6.calico": true,
+		"weave":           true,
+	}
+	interfacePrefixes = []string{"cali", "vxlan-"}
+	// cniBridges are the bridges the veth ends of pods are attached to, veths
+	// elsewhere belong to docker or other software.
+	cniBridges = map[string]bool{
+		"cni0":  true,
+		"weave": true,
+	}
+
+	sysClassNet = "/sys/class/net"
+
+	// chainPrefixes match the iptables chains of kube-proxy and the network
+	// plugins.
+	chainPrefixes = []string{"KUBE-", "CNI-", "cali-", "FLANNEL", "WEAVE", "CILIUM_"}
+
+	iptablesTables = []string{"filter", "nat", "mangle", "raw"}
+)
+
+func planInterfaces(opts *Options) ([]Action, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []Action
+	for _, iface := range interfaces {
+		if !cniInterface(iface.Name) {
+			continue
+		}
+		name := iface.Name
+		actions = append(actions, Action{
+			Category: Interfaces,
+			Target:   name,
+			apply: func() error {
+				_, err := opts.Run("ip", "link", "delete", name)
+				if err != nil && !exists(name) {
+					// Deleting one end of a veth pair removes the other.
+					return nil
+				}
+				return err
+			},
+		})
+	}
+	return actions, nil
+}
+
+func cniInterface(name string) bool {
+	if interfaceNames[name] {
+		return true
+	}
+	for _, prefix := range interfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(name, "veth") && cniBridges[master(name)]
+}
+
+// master returns the bridge the interface is attached to, if any.
+func master(name string) string {
+	link, err := os.Readlink(filepath.Join(sysClassNet, name, "master"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(link)
+}
+
+func exists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+func planIptables(opts *Options) []Action {
+	var actions []Action
+	for _, command := range []string{"iptables", "ip6tables"} {
+		for _, table := range iptablesTables {
+			// Missing commands and tables have nothing to clean up.
+			output, err := opts.Run(command+"-save", "-t", table)
+			if err != nil {
+				continue
+			}
+			actions = append(actions, planTable(opts, command, table, string(output))...)
+		}
+	}
+	return actions
+}
+
+// planTable removes the rules jumping to matching chains from the others,
+// then flushes every matching chain before deleting them, as they may jump to
+// each other.
+func planTable(opts *Options, command, table, save string) []Action {
+	var chains []string
+	var jumps [][]string
+	for _, line := range strings.Split(save, "\n") {
+		switch {
+		case strings.HasPrefix(line, ":"):
+			fields := strings.Fields(line[1:])
+			if len(fields) > 0 && matchingChain(fields[0]) {
+				chains = append(chains, fields[0])
+			}
+		case strings.HasPrefix(line, "-A "):
+			rule := splitRule(line[3:])
+			if len(rule) > 0 && !matchingChain(rule[0]) && matchingChain(jumpTarget(rule)) {
+				jumps = append(jumps, rule)
+			}
+		}
+	}
+
+	var actions []Action
+	add := func(args ...string) {
+		args = append([]string{command, "-t", table}, args...)
+		actions = append(actions, Action{
+			Category: Iptables,
+			Target:   strings.Join(args, " "),
+			apply: func() error {
+				_, err := opts.Run(args...)
+				return err
+			},
+		})
+	}
+	for _, rule := range jumps {
+		add(append([]string{"-D"}, rule...)...)
+	}
+	for _, chain := range chains {
+		add("-F", chain)
+	}
+	for _, chain := range chains {
+		add("-X", chain)
+	}
+	return actions
+}
+
+func matchingChain(chain string) bool {
+	for _, prefix := range chainPrefixes {
+		if strings.HasPrefix(chain, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func jumpTarget(rule []string) string {
+	for i := 0; i < len(rule)-1; i++ {
+		if rule[i] == "-j" || rule[i] == "-g" {
+			return rule[i+1]
+		}
+	}
+	return ""
+}
+
+// splitRule splits a rule from iptables-save into arguments, which quotes
+// those with spaces, such as comments.
+func splitRule(rule string) []string {
+	var args []string
+	var arg bytes.Buffer
+	inArg, quoted, escaped := false, false, false
+	for _, r := range rule {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case r == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	accessReviewPath = "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews"
+	accessTimeout    = 30 * time.Second
+)
+
+var allVerbs = []string{"get", "list", "watch", "create", "update", "delete"}
+
+// requiredAccess is the set of rights Rancher needs to manage an imported cluster.
+var requiredAccess = []accessRule{
+	{resource: "namespaces", verbs: allVerbs},
+	{resource: "nodes", verbs: []string{"get", "list", "watch", "update"}},
+	{resource: "secrets", verbs: allVerbs},
+	{resource: "serviceaccounts", verbs: allVerbs},
+	{resource: "configmaps", verbs: allVerbs},
+	{group: "rbac.authorization.k8s.io", resource: "clusterroles", verbs: allVerbs},
+	{group: "rbac.authorization.k8s.io", resource: "clusterrolebindings", verbs: allVerbs},
+	{group: "rbac.authorization.k8s.io", resource: "roles", verbs: allVerbs},
+	{group: "rbac.authorization.k8s.io", resource: "rolebindings", verbs: allVerbs},
+	{group: "apps", resource: "deployments", verbs: allVerbs},
+	{group: "apps", resource: "daemonsets", verbs: allVerbs},
+}
+
+type accessRule struct {
+	group    string
+	resource string
+	verbs    []string
+}
+
+type resourceAttributes struct {
+	Verb     string `json:"verb"`
+	Group    string `json:"group"`
+	Resource string `json:"resource"`
+}
+
+type accessReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		ResourceAttributes resourceAttributes `json:"resourceAttributes"`
+	} `json:"spec"`
+	Status struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason,omitempty"`
+	} `json:"status"`
+}
+
+func (a resourceAttributes) String() string {
+	if a.Group == "" {
+		return fmt.Sprintf("%s %s", a.Verb, a.Resource)
+	}
+	return fmt.Sprintf("%s %s.%s", a.Verb, a.Resource, a.Group)
+}
+
+// CheckAccess calls the Kubernetes API at address with the credentials Rancher
+// will use and fails if they can't be used to manage the cluster.
+func CheckAccess(address, token string, caData []byte) error {
+	if err := checkAccess(address, token, caData, requiredAccess); err != nil {
+		return err
+	}
+	logrus.Info("Service account has all required permissions")
+	return nil
+}
+
+// checkProxyAccess checks the service account can serve the Kubernetes API
+// proxy: it needs the required access itself, or the right to impersonate.
+func checkProxyAccess(address, token string, caData []byte, opts proxyOptions) error {
+	if opts.user == "" {
+		return CheckAccess(address, token, caData)
+	}
+
+	rules := []accessRule{{resource: "users", verbs: []string{"impersonate"}}}
+	if len(opts.groups) > 0 {
+		rules = append(rules, accessRule{resource: "groups", verbs: []string{"impersonate"}})
+	}
+	if err := checkAccess(address, token, caData, rules); err != nil {
+		return err
+	}
+	logrus.Infof("Service account may impersonate %s", opts.user)
+	return nil
+}
+
+func checkAccess(address, token string, caData []byte, rules []accessRule) error {
+	client, err := newAccessClient(address, token, caData)
+	if err != nil {
+		return err
+	}
+
+	info, err := client.version()
+	if err != nil {
+		return fmt.Errorf("failed to reach kubernetes API at %s: %v", address, err)
+	}
+	logrus.Infof("Kubernetes API at %s is reachable, server version %s", address, info)
+
+	var missing []string
+	for _, rule := range rules {
+		for _, verb := range rule.verbs {
+			attrs := resourceAttributes{
+				Verb:     verb,
+				Group:    rule.group,
+				Resource: rule.resource,
+			}
+			allowed, reason, err := client.review(attrs)
+			if err != nil {
+				return fmt.Errorf("failed to review access for %s: %v", attrs, err)
+			}
+			if !allowed {
+				if reason != "" {
+					missing = append(missing, fmt.Sprintf("%s (%s)", attrs, reason))
+				} else {
+					missing = append(missing, attrs.String())
+				}
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("service account is missing %d required permissions:\n\t%s",
+			len(missing), strings.Join(missing, "\n\t"))
+	}
+	return nil
+}
+
+type accessClient struct {
+	host   string
+	client *http.Client
+}
+
+func newAccessClient(address, token string, caData []byte) (*accessClient, error) {
+	cfg := &rest.Config{
+		Host:        "https://" + address,
+		BearerToken: token,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: caData,
+		},
+	}
+
+	transport, err := rest.TransportFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessClient{
+		host: cfg.Host,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   accessTimeout,
+		},
+	}, nil
+}
+
+func (c *accessClient) version() (*version.Info, error) {
+	resp, err := c.client.Get(c.host + "/version")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	info := &version.Info{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("failed to parse server version: %v", err)
+	}
+	if info.GitVersion == "" {
+		return nil, fmt.Errorf("server did not report a version")
+	}
+	return info, nil
+}
+
+func (c *accessClient) review(attrs resourceAttributes) (bool, string, error) {
+	review := accessReview{
+		APIVersion: "authorization.k8s.io/v1",
+		Kind:       "SelfSubjectAccessReview",
+	}
+	review.Spec.ResourceAttributes = attrs
+
+	body, err := json.Marshal(review)
+	if err != nil {
+		return false, "", err
+	}
+
+	resp, err := c.client.Post(c.host+accessReviewPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return false, "", err
+	}
+
+	result := accessReview{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, "", err
+	}
+	return result.Status.Allowed, result.Status.Reason, nil
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("token was rejected: %s", strings.TrimSpace(string(body)))
+	case http.StatusForbidden:
+		return fmt.Errorf("access denied: %s", strings.TrimSpace(string(body)))
+	}
+	return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
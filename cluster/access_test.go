@@ -0,0 +1,181 @@
+package cluster
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testToken = "service-account-token"
+
+// fakeAPI answers version requests and access reviews like the Kubernetes
+// API, denying the reviews in denied.
+type fakeAPI struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	denied   map[resourceAttributes]string
+	status   int
+	reviewed []resourceAttributes
+}
+
+func newFakeAPI(l net.Listener) *fakeAPI {
+	api := &fakeAPI{denied: map[resourceAttributes]string{}}
+	api.Server = httptest.NewUnstartedServer(http.HandlerFunc(api.serve))
+	if l != nil {
+		api.Listener.Close()
+		api.Listener = l
+	}
+	api.StartTLS()
+	return api
+}
+
+func (a *fakeAPI) serve(rw http.ResponseWriter, req *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if req.Header.Get("Authorization") != "Bearer "+testToken {
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if a.status != 0 {
+		http.Error(rw, "refused", a.status)
+		return
+	}
+
+	switch req.URL.Path {
+	case "/version":
+		rw.Write([]byte(`{"gitVersion": "v1.16.3"}`))
+	case accessReviewPath:
+		review := accessReview{}
+		if err := json.NewDecoder(req.Body).Decode(&review); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		attrs := review.Spec.ResourceAttributes
+		a.reviewed = append(a.reviewed, attrs)
+		reason, denied := a.denied[attrs]
+		review.Status.Allowed = !denied
+		review.Status.Reason = reason
+		json.NewEncoder(rw).Encode(review)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (a *fakeAPI) reviews() []resourceAttributes {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.reviewed
+}
+
+func (a *fakeAPI) address() string {
+	u, _ := url.Parse(a.URL)
+	return u.Host
+}
+
+func (a *fakeAPI) caData() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.Certificate().Raw})
+}
+
+func TestCheckAccess(t *testing.T) {
+	api := newFakeAPI(nil)
+	defer api.Close()
+
+	if err := CheckAccess(api.address(), testToken, api.caData()); err != nil {
+		t.Fatal(err)
+	}
+
+	reviewed := map[string]bool{}
+	for _, attrs := range api.reviews() {
+		reviewed[attrs.String()] = true
+	}
+	for _, attrs := range []string{"list namespaces", "update nodes", "create deployments.apps", "watch daemonsets.apps", "delete clusterrolebindings.rbac.authorization.k8s.io"} {
+		if !reviewed[attrs] {
+			t.Errorf("%s was not reviewed", attrs)
+		}
+	}
+	for attrs := range reviewed {
+		if strings.HasSuffix(attrs, ".extensions") {
+			t.Errorf("%s is reviewed in a group removed in Kubernetes 1.16", attrs)
+		}
+	}
+}
+
+func TestCheckAccessMissing(t *testing.T) {
+	api := newFakeAPI(nil)
+	defer api.Close()
+	api.denied[resourceAttributes{Verb: "delete", Resource: "secrets"}] = ""
+	api.denied[resourceAttributes{Verb: "create", Group: "apps", Resource: "daemonsets"}] = "RBAC: not bound"
+
+	err := CheckAccess(api.address(), testToken, api.caData())
+	if err == nil {
+		t.Fatal("missing permissions were not reported")
+	}
+	for _, expected := range []string{"missing 2 required permissions", "\tdelete secrets\n", "\tcreate daemonsets.apps (RBAC: not bound)"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q does not contain %q", err, expected)
+		}
+	}
+}
+
+func TestCheckAccessRefused(t *testing.T) {
+	api := newFakeAPI(nil)
+	defer api.Close()
+
+	for _, test := range []struct {
+		token    string
+		status   int
+		expected string
+	}{
+		{"wrong-token", 0, "token was rejected: Unauthorized"},
+		{testToken, http.StatusForbidden, "access denied: refused"},
+		{testToken, http.StatusServiceUnavailable, "unexpected response 503 Service Unavailable: refused"},
+	} {
+		api.lock.Lock()
+		api.status = test.status
+		api.lock.Unlock()
+
+		err := checkAccess(api.address(), test.token, api.caData(), requiredAccess)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%d: got %v, expected %q", test.status, err, test.expected)
+		}
+	}
+}
+
+func TestCheckProxyAccess(t *testing.T) {
+	api := newFakeAPI(nil)
+	defer api.Close()
+
+	opts := proxyOptions{enabled: true, user: "rancher", groups: []string{"system:masters"}}
+	if err := checkProxyAccess(api.address(), testToken, api.caData(), opts); err != nil {
+		t.Fatal(err)
+	}
+	reviewed := api.reviews()
+	if len(reviewed) != 2 || reviewed[0].String() != "impersonate users" || reviewed[1].String() != "impersonate groups" {
+		t.Errorf("reviewed %v, expected impersonating users and groups", reviewed)
+	}
+}
+
+func TestCheckAccessIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	api := newFakeAPI(l)
+	defer api.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckAccess(net.JoinHostPort("::1", port), testToken, api.caData()); err != nil {
+		t.Fatal(err)
+	}
+}
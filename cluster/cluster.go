@@ -4,9 +4,15 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
 
+	"github.com/rancher/agent/mode"
+	"github.com/rancher/agent/params"
+	"github.com/rancher/agent/preflight"
+	"github.com/rancher/agent/redact"
+	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/rest"
 )
 
@@ -19,11 +25,26 @@ const (
 	kubernetesServicePortKey = "KUBERNETES_SERVICE_PORT"
 )
 
+func init() {
+	params.Register(mode.Cluster, Provider{})
+}
+
+// Provider builds the registration params for an imported cluster.
+type Provider struct{}
+
+func (Provider) TokenAndURL() (string, string, error) {
+	return TokenAndURL()
+}
+
+func (Provider) Params() (*params.Payload, error) {
+	return Params()
+}
+
 func TokenAndURL() (string, string, error) {
 	return getRancherClient()
 }
 
-func Params() (map[string]interface{}, error) {
+func Params() (*params.Payload, error) {
 	cfg, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, err
@@ -32,6 +53,7 @@ func Params() (map[string]interface{}, error) {
 	if err := populateCAData(cfg); err != nil {
 		return nil, err
 	}
+	redact.AddSecret(cfg.BearerToken)
 
 	kubernetesServiceHost, err := getenv(kubernetesServiceHostKey)
 	if err != nil {
@@ -42,11 +64,37 @@ func Params() (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	return map[string]interface{}{
-		"cluster": map[string]interface{}{
-			"address": fmt.Sprintf("%s:%s", kubernetesServiceHost, kubernetesServicePort),
-			"token":   cfg.BearerToken,
-			"caCert":  base64.StdEncoding.EncodeToString(cfg.CAData),
+	address := net.JoinHostPort(kubernetesServiceHost, kubernetesServicePort)
+
+	proxy := currentProxyOptions()
+	if proxy.enabled {
+		if err := checkProxyAccess(address, cfg.BearerToken, cfg.CAData, proxy); err != nil {
+			preflight.Record("kube-access", preflight.Fail, err.Error())
+			return nil, err
+		}
+		preflight.Record("kube-access", preflight.Pass, "service account can serve the Kubernetes API proxy")
+		logrus.Infof("Serving the Kubernetes API at %s through the tunnel, the service account token is not sent", ProxyAddress)
+		return &params.Payload{
+			Version: params.Version,
+			Cluster: &params.Cluster{
+				Address: ProxyAddress,
+				Proxy:   true,
+			},
+		}, nil
+	}
+
+	if err := CheckAccess(address, cfg.BearerToken, cfg.CAData); err != nil {
+		preflight.Record("kube-access", preflight.Fail, err.Error())
+		return nil, err
+	}
+	preflight.Record("kube-access", preflight.Pass, "service account has all required permissions")
+
+	return &params.Payload{
+		Version: params.Version,
+		Cluster: &params.Cluster{
+			Address: address,
+			Token:   cfg.BearerToken,
+			CACert:  base64.StdEncoding.EncodeToString(cfg.CAData),
 		},
 	}, nil
 }
@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rancher/agent/tunnel"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// ProxyAddress is where the agent serves the Kubernetes API to the server
+// through the tunnel, over plain HTTP since the tunnel is encrypted.
+const ProxyAddress = "kubernetes." + tunnel.AgentDomain + ":80"
+
+// proxyOptions configure the Kubernetes API proxy from the environment.
+type proxyOptions struct {
+	enabled bool
+	user    string
+	groups  []string
+}
+
+func currentProxyOptions() proxyOptions {
+	opts := proxyOptions{
+		enabled: os.Getenv("CATTLE_KUBE_API_PROXY") == "true",
+		user:    os.Getenv("CATTLE_KUBE_API_IMPERSONATE_USER"),
+	}
+	for _, group := range strings.Split(os.Getenv("CATTLE_KUBE_API_IMPERSONATE_GROUPS"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			opts.groups = append(opts.groups, group)
+		}
+	}
+	return opts
+}
+
+// NewProxy returns a handler forwarding the server's requests to the
+// Kubernetes API with the agent's service account, so its token never leaves
+// the cluster. With CATTLE_KUBE_API_IMPERSONATE_USER set the requests
+// impersonate that user instead of acting as the service account.
+func NewProxy() (http.Handler, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := currentProxyOptions()
+	if opts.user != "" {
+		cfg.Impersonate = rest.ImpersonationConfig{
+			UserName: opts.user,
+			Groups:   opts.groups,
+		}
+		logrus.Infof("Kubernetes API proxy impersonates user %s, groups %v", opts.user, opts.groups)
+	}
+
+	transport, err := rest.TransportFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+		// The transport only adds the agent's credentials when the request
+		// carries none.
+		req.Header.Del("Authorization")
+		if opts.user != "" {
+			for key := range req.Header {
+				if strings.HasPrefix(key, "Impersonate-") {
+					req.Header.Del(key)
+				}
+			}
+		}
+	}
+	return proxy, nil
+}
@@ -0,0 +1,142 @@
+package credential
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileName is where the credential is kept in the state directory.
+const fileName = "node-credential.json"
+
+// Credential is the token the server issued to this node in exchange for the
+// registration token.
+type Credential struct {
+	// Server is the host the credential was issued by, it is not sent to
+	// any other.
+	Server   string    `json:"server"`
+	Token    string    `json:"token"`
+	IssuedAt time.Time `json:"issuedAt"`
+	// ExpiresAt is nil for a credential that doesn't expire.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// RevokedAt is when the server rejected the credential. It is kept so
+	// the agent doesn't register again with the registration token on
+	// restart.
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Expired returns whether the credential is no longer valid at now.
+func (c *Credential) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// RenewAt returns when two thirds of the lifetime of the credential are over,
+// or the zero time if it doesn't expire.
+func (c *Credential) RenewAt() time.Time {
+	if c.ExpiresAt == nil {
+		return time.Time{}
+	}
+	lifetime := c.ExpiresAt.Sub(c.IssuedAt)
+	return c.IssuedAt.Add(lifetime * 2 / 3)
+}
+
+// load reads the credential in dir, nil if there is none.
+func load(dir string) (*Credential, error) {
+	path := filepath.Join(dir, fileName)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(path, 0600); err != nil {
+			return nil, fmt.Errorf("%s is readable by other users and can't be restricted: %v", path, err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	credential := &Credential{}
+	if err := json.Unmarshal(data, credential); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if credential.Token == "" {
+		return nil, fmt.Errorf("%s has no token", path)
+	}
+	return credential, nil
+}
+
+// save writes the credential to dir through a temporary file, so a crash
+// leaves the old or the new one. Only root can read either.
+func save(dir string, credential *Credential) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(credential, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, fileName)
+	tmp, err := ioutil.TempFile(dir, "."+fileName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// inContainer returns whether the agent runs in a docker container.
+func inContainer() bool {
+	_, err := os.Stat("/.dockerenv")
+	return err == nil
+}
+
+// mounted returns whether dir is on a file system mounted at or above it,
+// other than the root, such as a bind mount from the host.
+func mounted(dir string) bool {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		// Don't warn when it can't be told.
+		return true
+	}
+	return mountedIn(string(data), dir)
+}
+
+func mountedIn(mountinfo, dir string) bool {
+	dir = filepath.Clean(dir)
+	for _, line := range strings.Split(mountinfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] == "/" {
+			continue
+		}
+		mountPoint := filepath.Clean(fields[4])
+		if dir == mountPoint || strings.HasPrefix(dir, mountPoint+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package credential
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/agent/server"
+)
+
+const (
+	bootstrapPath = "/v3/connect/bootstrap"
+	renewPath     = "/v3/connect/renew"
+
+	// tokenHeader carries the registration token to bootstrap with, or the
+	// credential to renew.
+	tokenHeader  = "X-API-Tunnel-Token"
+	paramsHeader = "X-API-Tunnel-Params"
+)
+
+// statusError is a non-2xx answer of the server to an exchange.
+type statusError struct {
+	path   string
+	status string
+	code   int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.path, e.status, e.body)
+}
+
+// rejected returns whether err is the server refusing the token, such as a
+// revoked credential.
+func rejected(err error) bool {
+	statusErr, ok := err.(*statusError)
+	return ok && (statusErr.code == http.StatusUnauthorized || statusErr.code == http.StatusForbidden)
+}
+
+// unsupported returns whether err is the server not knowing the exchange, as
+// servers that don't issue credentials answer.
+func unsupported(err error) bool {
+	statusErr, ok := err.(*statusError)
+	return ok && (statusErr.code == http.StatusNotFound || statusErr.code == http.StatusMethodNotAllowed)
+}
+
+type exchangeResponse struct {
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type exchanger struct {
+	server *url.URL
+	client *http.Client
+	params string
+}
+
+func newExchanger(server *url.URL, tlsConfig *tls.Config, params string, timeout time.Duration) *exchanger {
+	return &exchanger{
+		server: server,
+		params: params,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+}
+
+// bootstrap exchanges the registration token for a credential of this node,
+// identified by the params.
+func (e *exchanger) bootstrap(registrationToken string) (*Credential, error) {
+	return e.exchange(bootstrapPath, registrationToken)
+}
+
+// renew exchanges a credential for a new one before it expires.
+func (e *exchanger) renew(credential *Credential) (*Credential, error) {
+	return e.exchange(renewPath, credential.Token)
+}
+
+func (e *exchanger) exchange(path, token string) (*Credential, error) {
+	req, err := http.NewRequest(http.MethodPost, server.URL(e.server, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(tokenHeader, token)
+	req.Header.Set(paramsHeader, e.params)
+
+	now := time.Now()
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &statusError{
+			path:   path,
+			status: resp.Status,
+			code:   resp.StatusCode,
+			body:   strings.TrimSpace(string(body)),
+		}
+	}
+
+	response := exchangeResponse{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if response.Token == "" {
+		return nil, fmt.Errorf("%s returned no token", path)
+	}
+	if response.ExpiresAt != nil && !response.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("%s returned a token that expired at %s", path, response.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return &Credential{
+		Server:    e.server.Host,
+		Token:     response.Token,
+		IssuedAt:  now,
+		ExpiresAt: response.ExpiresAt,
+	}, nil
+}
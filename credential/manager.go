@@ -0,0 +1,297 @@
+package credential
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rancher/agent/redact"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTimeout       = 30 * time.Second
+	DefaultRetryInterval = time.Minute
+)
+
+// Options describe where the credential is kept and who issues it.
+type Options struct {
+	// Dir is the agent state directory, the credential is kept in it.
+	Dir       string
+	Server    *url.URL
+	TLSConfig *tls.Config
+	// RegistrationToken is exchanged for a credential, and connected with
+	// while there is none.
+	RegistrationToken string
+	// Params is the encoded params header, which identifies the node.
+	Params        string
+	Timeout       time.Duration
+	RetryInterval time.Duration
+}
+
+// Manager keeps the node credential current. The registration token is only
+// used until the server issued a credential: once it has, a credential the
+// server rejects or that expires revokes the node instead. A registration
+// token the server rejects stops the node too.
+type Manager struct {
+	opts      Options
+	exchanger *exchanger
+
+	lock        sync.Mutex
+	current     *Credential
+	next        time.Time
+	unsupported bool
+	rejected    chan string
+	revoked     chan struct{}
+	err         error
+}
+
+// New returns a Manager, Start must be called before Run.
+func New(opts Options) *Manager {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+	return &Manager{
+		opts:      opts,
+		exchanger: newExchanger(opts.Server, opts.TLSConfig, opts.Params, opts.Timeout),
+		rejected:  make(chan string, 1),
+		revoked:   make(chan struct{}),
+	}
+}
+
+// Start loads the stored credential, or obtains one with the registration
+// token, and returns the token to connect with. It fails if the stored
+// credential can't be used, as the node must not register again, or if the
+// server rejected the registration token.
+func (m *Manager) Start() (string, error) {
+	if inContainer() && !mounted(m.opts.Dir) {
+		logrus.Warnf("%s is not mounted from the host, the node credential is lost when the container is recreated "+
+			"and the node can't connect again; bind mount it with -v %s:%s", m.opts.Dir, m.opts.Dir, m.opts.Dir)
+	}
+
+	path := filepath.Join(m.opts.Dir, fileName)
+	credential, err := load(m.opts.Dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the node credential, remove %s to register the node again: %v", path, err)
+	}
+
+	switch {
+	case credential == nil:
+		credential = m.bootstrap()
+	case credential.Server != m.opts.Server.Host:
+		logrus.Warnf("Ignoring the node credential issued by %s, the server is %s", credential.Server, m.opts.Server.Host)
+		credential = m.bootstrap()
+	case credential.RevokedAt != nil:
+		return "", fmt.Errorf("the node credential was revoked at %s, remove %s to register the node again",
+			credential.RevokedAt.Format(time.RFC3339), path)
+	case credential.Expired(time.Now()):
+		return "", fmt.Errorf("the node credential expired at %s, remove %s to register the node again",
+			credential.ExpiresAt.Format(time.RFC3339), path)
+	default:
+		redact.AddSecret(credential.Token)
+		logrus.Infof("Using the node credential from %s%s", m.opts.Dir, expiry(credential))
+	}
+
+	if err := m.Err(); err != nil {
+		return "", err
+	}
+	m.set(credential)
+	return m.Token(), nil
+}
+
+// Token returns the credential, or the registration token if there is none.
+func (m *Manager) Token() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.current == nil {
+		return m.opts.RegistrationToken
+	}
+	return m.current.Token
+}
+
+// Revoked is closed once the server rejected the credential or the
+// registration token, or the credential expired, Err returns why.
+func (m *Manager) Revoked() <-chan struct{} {
+	return m.revoked
+}
+
+// Err returns why Revoked was closed, nil while it wasn't.
+func (m *Manager) Err() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err
+}
+
+// Rejected tells the manager the server refused to connect with token. If it
+// is the current credential, Run renews it right away: the credential is only
+// revoked if the server rejects the renewal too, a tunnel can be refused for
+// other reasons.
+func (m *Manager) Rejected(token string) {
+	select {
+	case m.rejected <- token:
+	default:
+	}
+}
+
+// Run renews the credential before it expires or when the tunnel rejected
+// it, or retries obtaining one, and calls onChange with the token to connect
+// with whenever it changes. It returns once there is nothing left to do: the
+// server doesn't issue credentials, or the credential or the registration
+// token was rejected.
+func (m *Manager) Run(onChange func(token string)) {
+	for {
+		m.lock.Lock()
+		current, next, unsupported, err := m.current, m.next, m.unsupported, m.err
+		m.lock.Unlock()
+
+		if unsupported || err != nil {
+			return
+		}
+		// A credential that doesn't expire is only renewed when rejected.
+		var renewAt <-chan time.Time
+		if current == nil || current.ExpiresAt != nil {
+			renewAt = time.After(time.Until(next))
+		}
+		select {
+		case <-renewAt:
+		case token := <-m.rejected:
+			if current == nil || current.Token != token {
+				continue
+			}
+			logrus.Warnf("The server refused to connect with the node credential, renewing it to check if it was revoked")
+		case <-m.revoked:
+			return
+		}
+
+		token := m.Token()
+		if current == nil {
+			m.set(m.bootstrap())
+		} else {
+			m.renew(current)
+		}
+		if changed := m.Token(); changed != token {
+			onChange(changed)
+		}
+	}
+}
+
+// bootstrap exchanges the registration token, nil retries later. Only a
+// server that doesn't know the exchange doesn't issue credentials, one that
+// rejects the registration token stops the node.
+func (m *Manager) bootstrap() *Credential {
+	credential, err := m.exchanger.bootstrap(m.opts.RegistrationToken)
+	switch {
+	case err == nil:
+	case unsupported(err):
+		logrus.Infof("The server does not issue node credentials, connecting with the registration token: %v", err)
+		m.lock.Lock()
+		m.unsupported = true
+		m.lock.Unlock()
+		return nil
+	case rejected(err):
+		m.stop(fmt.Errorf("the server rejected the registration token: %v", err))
+		return nil
+	default:
+		logrus.Warnf("Failed to exchange the registration token for a node credential, connecting with the registration token "+
+			"and retrying in %s: %v", m.opts.RetryInterval, err)
+		return nil
+	}
+
+	redact.AddSecret(credential.Token)
+	m.save(credential)
+	logrus.Infof("Obtained a node credential%s", expiry(credential))
+	return credential
+}
+
+func (m *Manager) renew(current *Credential) {
+	credential, err := m.exchanger.renew(current)
+	switch {
+	case err == nil:
+		redact.AddSecret(credential.Token)
+		m.save(credential)
+		m.set(credential)
+		logrus.Infof("Renewed the node credential%s", expiry(credential))
+	case rejected(err):
+		m.revoke(current, fmt.Errorf("the server rejected the node credential: %v", err))
+	case current.Expired(time.Now()):
+		m.revoke(current, fmt.Errorf("the node credential expired at %s before it could be renewed: %v",
+			current.ExpiresAt.Format(time.RFC3339), err))
+	default:
+		retry := time.Now().Add(m.opts.RetryInterval)
+		if current.ExpiresAt != nil && retry.After(*current.ExpiresAt) {
+			retry = *current.ExpiresAt
+		}
+		logrus.Warnf("Failed to renew the node credential, retrying at %s: %v", retry.Format(time.RFC3339), err)
+		m.lock.Lock()
+		m.next = retry
+		m.lock.Unlock()
+	}
+}
+
+// revoke records that credential can't be used anymore, so the agent stops
+// rather than registering again with the registration token.
+func (m *Manager) revoke(credential *Credential, reason error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return
+	}
+
+	logrus.Errorf("The node is revoked, %v; remove %s to register it again", reason, filepath.Join(m.opts.Dir, fileName))
+	now := time.Now()
+	revoked := *credential
+	revoked.RevokedAt = &now
+	if err := save(m.opts.Dir, &revoked); err != nil {
+		logrus.Warnf("Failed to record the revocation in %s: %v", m.opts.Dir, err)
+	}
+
+	m.err = reason
+	close(m.revoked)
+}
+
+// stop records that the node can't connect without a credential to revoke,
+// as when the registration token was rejected.
+func (m *Manager) stop(reason error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return
+	}
+
+	m.err = reason
+	close(m.revoked)
+}
+
+// set makes credential current, nil connects with the registration token
+// and retries obtaining one later.
+func (m *Manager) set(credential *Credential) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.current = credential
+	if credential == nil {
+		m.next = time.Now().Add(m.opts.RetryInterval)
+	} else {
+		m.next = credential.RenewAt()
+	}
+}
+
+func (m *Manager) save(credential *Credential) {
+	if err := save(m.opts.Dir, credential); err != nil {
+		logrus.Warnf("Failed to store the node credential in %s, another one is requested on restart: %v", m.opts.Dir, err)
+	}
+}
+
+func expiry(credential *Credential) string {
+	if credential.ExpiresAt == nil {
+		return ", it does not expire"
+	}
+	return ", it expires at " + credential.ExpiresAt.Format(time.RFC3339)
+}
@@ -0,0 +1,447 @@
+package credential
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const registrationToken = "registration-token-0123456789"
+
+// fakeServer issues credentials like a server supporting the exchange, the
+// answers can be changed by the tests.
+type fakeServer struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	status    map[string]int
+	lifetime  time.Duration
+	issued    int
+	requests  map[string]int
+	lastToken map[string]string
+}
+
+func newFakeServer() *fakeServer {
+	s := &fakeServer{
+		status:    map[string]int{},
+		requests:  map[string]int{},
+		lastToken: map[string]string{},
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeServer) serve(rw http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests[req.URL.Path]++
+	s.lastToken[req.URL.Path] = req.Header.Get(tokenHeader)
+	if status := s.status[req.URL.Path]; status != 0 {
+		http.Error(rw, "refused", status)
+		return
+	}
+
+	s.issued++
+	response := exchangeResponse{Token: "node-credential-" + strings.Repeat("x", s.issued)}
+	if s.lifetime > 0 {
+		expiresAt := time.Now().Add(s.lifetime)
+		response.ExpiresAt = &expiresAt
+	}
+	json.NewEncoder(rw).Encode(response)
+}
+
+func (s *fakeServer) set(path string, status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status[path] = status
+}
+
+func (s *fakeServer) setLifetime(lifetime time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lifetime = lifetime
+}
+
+func (s *fakeServer) token(path string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastToken[path]
+}
+
+func (s *fakeServer) count(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[path]
+}
+
+func (s *fakeServer) options(t *testing.T, dir string) Options {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	return Options{
+		Dir:               dir,
+		Server:            u,
+		TLSConfig:         &tls.Config{RootCAs: pool},
+		RegistrationToken: registrationToken,
+		Params:            "e30=",
+		Timeout:           5 * time.Second,
+		RetryInterval:     50 * time.Millisecond,
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "credential")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// runner runs a manager in the background and records the tokens it changes
+// to.
+type runner struct {
+	lock   sync.Mutex
+	tokens []string
+	done   chan struct{}
+}
+
+func start(m *Manager) *runner {
+	r := &runner{done: make(chan struct{})}
+	go func() {
+		m.Run(func(token string) {
+			r.lock.Lock()
+			r.tokens = append(r.tokens, token)
+			r.lock.Unlock()
+		})
+		close(r.done)
+	}()
+	return r
+}
+
+func (r *runner) changes() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.tokens...)
+}
+
+func (r *runner) wait(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+		t.Fatalf("Run did not return within %s", timeout)
+	}
+}
+
+// run runs the manager until it returns, at most for timeout, and returns the
+// tokens it changed to.
+func run(t *testing.T, m *Manager, timeout time.Duration) []string {
+	t.Helper()
+	r := start(m)
+	r.wait(t, timeout)
+	return r.changes()
+}
+
+// waitFor waits up to timeout for condition to be true.
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool, message string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBootstrapUnsupported(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed} {
+		server := newFakeServer()
+		dir := tempDir(t)
+
+		server.set(bootstrapPath, status)
+		m := New(server.options(t, dir))
+		token, err := m.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != registrationToken {
+			t.Errorf("%d: connecting with %q, expected the registration token", status, token)
+		}
+		run(t, m, time.Second)
+		if n := server.count(bootstrapPath); n != 1 {
+			t.Errorf("%d: bootstrapped %d times, expected once", status, n)
+		}
+
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBootstrapRetried(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusBadRequest} {
+		server := newFakeServer()
+		dir := tempDir(t)
+
+		server.set(bootstrapPath, status)
+		m := New(server.options(t, dir))
+		token, err := m.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != registrationToken {
+			t.Errorf("%d: connecting with %q, expected the registration token", status, token)
+		}
+
+		r := start(m)
+		waitFor(t, 5*time.Second, func() bool { return server.count(bootstrapPath) >= 3 },
+			"the bootstrap was not retried")
+		server.set(bootstrapPath, 0)
+		waitFor(t, 5*time.Second, func() bool { return len(r.changes()) > 0 },
+			"no credential was obtained once the server issued one")
+		if tokens := r.changes(); tokens[0] != "node-credential-x" {
+			t.Errorf("%d: changed to %v, expected the credential", status, tokens)
+		}
+
+		// Stop Run by having the server revoke the credential.
+		server.set(renewPath, http.StatusUnauthorized)
+		m.Rejected(m.Token())
+		r.wait(t, 5*time.Second)
+
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBootstrapRejected(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		server := newFakeServer()
+		dir := tempDir(t)
+
+		server.set(bootstrapPath, status)
+		m := New(server.options(t, dir))
+		if _, err := m.Start(); err == nil || !strings.Contains(err.Error(), "rejected the registration token") {
+			t.Errorf("%d: starting with a rejected registration token returned %v", status, err)
+		}
+
+		// Rejected while retrying after a failure.
+		server.set(bootstrapPath, http.StatusServiceUnavailable)
+		m = New(server.options(t, dir))
+		if _, err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		server.set(bootstrapPath, status)
+		run(t, m, 5*time.Second)
+		select {
+		case <-m.Revoked():
+		default:
+			t.Errorf("%d: the node did not stop", status)
+		}
+		if err := m.Err(); err == nil || !strings.Contains(err.Error(), "rejected the registration token") {
+			t.Errorf("%d: stopped with %v", status, err)
+		}
+		// There is no credential to mark revoked, a fixed token can register.
+		if stored, err := load(dir); err != nil || stored != nil {
+			t.Errorf("%d: stored %+v, %v", status, stored, err)
+		}
+
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBootstrapAndRenew(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	server.setLifetime(300 * time.Millisecond)
+	m := New(server.options(t, dir))
+	token, err := m.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "node-credential-x" || server.token(bootstrapPath) != registrationToken {
+		t.Fatalf("bootstrapped %q with %q", token, server.token(bootstrapPath))
+	}
+
+	info, err := os.Stat(filepath.Join(dir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("credential is stored with mode %s", info.Mode())
+	}
+
+	// Stop renewing after the first renewal.
+	go func() {
+		for server.count(renewPath) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		server.setLifetime(0)
+	}()
+	r := start(m)
+	waitFor(t, 5*time.Second, func() bool {
+		tokens := r.changes()
+		stored, _ := load(dir)
+		return len(tokens) > 0 && stored != nil && stored.ExpiresAt == nil && tokens[len(tokens)-1] == stored.Token
+	}, "the credential was not renewed to one that doesn't expire")
+	tokens := r.changes()
+	if tokens[0] != "node-credential-xx" {
+		t.Fatalf("changed to %v, expected the renewed credential", tokens)
+	}
+	// Each renewal is made with the credential it replaces.
+	chain := append([]string{token}, tokens...)
+	if renewed := server.token(renewPath); renewed != chain[len(chain)-2] {
+		t.Errorf("renewed with %q, expected %q", renewed, chain[len(chain)-2])
+	}
+
+	stored, err := load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Token != m.Token() {
+		t.Errorf("stored %q, using %q", stored.Token, m.Token())
+	}
+
+	server.set(renewPath, http.StatusUnauthorized)
+	m.Rejected(m.Token())
+	r.wait(t, 5*time.Second)
+}
+
+func TestRenewRejected(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	server.setLifetime(300 * time.Millisecond)
+	server.set(renewPath, http.StatusUnauthorized)
+	m := New(server.options(t, dir))
+	if _, err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	run(t, m, 5*time.Second)
+
+	select {
+	case <-m.Revoked():
+	default:
+		t.Fatal("the credential was not revoked")
+	}
+	if m.Err() == nil || m.Token() == registrationToken {
+		t.Errorf("revoked with %v, connecting with %q", m.Err(), m.Token())
+	}
+	if n := server.count(bootstrapPath); n != 1 {
+		t.Errorf("bootstrapped %d times after the credential was rejected", n)
+	}
+
+	// The node doesn't register again on restart.
+	if _, err := New(server.options(t, dir)).Start(); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("restarting with a revoked credential returned %v", err)
+	}
+	if n := server.count(bootstrapPath); n != 1 {
+		t.Errorf("bootstrapped %d times after restarting revoked", n)
+	}
+}
+
+func TestRejectedByTunnel(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	m := New(server.options(t, dir))
+	token, err := m.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A credential that doesn't expire is only renewed when rejected.
+	r := start(m)
+	m.Rejected(registrationToken)
+	time.Sleep(100 * time.Millisecond)
+	if n := server.count(renewPath); n != 0 || m.Err() != nil {
+		t.Fatalf("rejecting another token renewed the credential %d times: %v", n, m.Err())
+	}
+
+	// The server renews the credential, the tunnel was refused for another
+	// reason.
+	m.Rejected(token)
+	waitFor(t, 5*time.Second, func() bool { return len(r.changes()) > 0 }, "the credential was not renewed")
+	if renewed := server.token(renewPath); renewed != token {
+		t.Errorf("renewed with %q, expected %q", renewed, token)
+	}
+	renewed := r.changes()[0]
+	if renewed != "node-credential-xx" || m.Err() != nil {
+		t.Fatalf("changed to %q, revoked with %v", renewed, m.Err())
+	}
+
+	// The server rejects the renewal too.
+	server.set(renewPath, http.StatusForbidden)
+	m.Rejected(renewed)
+	r.wait(t, 5*time.Second)
+	select {
+	case <-m.Revoked():
+	default:
+		t.Fatal("the credential was not revoked")
+	}
+	if n := server.count(renewPath); n != 2 {
+		t.Errorf("renewed %d times, expected twice", n)
+	}
+	if _, err := New(server.options(t, dir)).Start(); err == nil {
+		t.Error("restarting with a revoked credential succeeded")
+	}
+}
+
+func TestStartExpired(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := server.options(t, dir)
+	issuedAt := time.Now().Add(-time.Hour)
+	expiresAt := issuedAt.Add(time.Minute)
+	if err := save(dir, &Credential{Server: opts.Server.Host, Token: "expired", IssuedAt: issuedAt, ExpiresAt: &expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(opts).Start(); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("starting with an expired credential returned %v", err)
+	}
+	if n := server.count(bootstrapPath); n != 0 {
+		t.Errorf("bootstrapped %d times with an expired credential", n)
+	}
+}
+
+func TestMountedIn(t *testing.T) {
+	mountinfo := "" +
+		"611 530 0:52 / / rw,relatime - overlay overlay rw\n" +
+		"640 611 8:1 /var/lib/rancher/agent /var/lib/rancher/agent rw,relatime - ext4 /dev/sda1 rw\n" +
+		"641 611 8:1 /var/run /var/run rw,relatime - tmpfs tmpfs rw\n"
+	for dir, expected := range map[string]bool{
+		"/var/lib/rancher/agent":       true,
+		"/var/lib/rancher/agent/state": true,
+		"/var/run/rancher":             true,
+		"/var/lib/rancher":             false,
+		"/var/lib/rancher/agent2":      false,
+	} {
+		if mountedIn(mountinfo, dir) != expected {
+			t.Errorf("%s: mounted should be %v", dir, expected)
+		}
+	}
+}
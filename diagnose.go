@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rancher/agent/diagnose"
+	"github.com/rancher/agent/server"
+	"github.com/sirupsen/logrus"
+)
+
+func diagnoseCommand(args []string) error {
+	fs, opts := newFlagSet("diagnose")
+	timeout := fs.Duration("timeout", diagnose.DefaultTimeout, "timeout for each stage")
+	if err := parse(fs, opts, args); err != nil {
+		return err
+	}
+
+	reg, err := resolve(opts)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := server.TLSConfig(reg.server, opts.tls)
+	if err != nil {
+		// the ca-checksum stage explains checksum failures
+		logrus.Warnf("Failed to build TLS config, diagnosing without the CA checksum: %v", err)
+		withoutChecksum := opts.tls
+		withoutChecksum.CAChecksum = ""
+		if tlsConfig, err = server.TLSConfig(reg.server, withoutChecksum); err != nil {
+			return err
+		}
+	}
+
+	ok := diagnose.Run(os.Stdout, diagnose.Target{
+		Server:     reg.server,
+		ConnectURL: reg.wsURL,
+		Headers:    reg.headers,
+		CAChecksum: opts.tls.CAChecksum,
+		TLSConfig:  tlsConfig,
+		Timeout:    *timeout,
+	})
+	if !ok {
+		return fmt.Errorf("connection to %s failed, see above", reg.server.Host)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package diagnose
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/server"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+
+	maxBodySize = 1024
+
+	// paramsHeader carries the registration params, it is never sent: with
+	// them the server would register the node and connect its tunnel.
+	paramsHeader = "X-API-Tunnel-Params"
+)
+
+// Target describes the connection main.run would make.
+type Target struct {
+	// Server is the configured server URL, e.g. https://rancher.example.com.
+	Server *url.URL
+	// ConnectURL is the websocket URL of the tunnel endpoint.
+	ConnectURL string
+	// Headers are the tunnel headers. Only the token is sent, the upgrade
+	// checks it without registering the node.
+	Headers http.Header
+	// CAChecksum is the expected sha256 of the server CA certificates, if any.
+	CAChecksum string
+	// TLSConfig is used for every TLS connection, nil means system defaults.
+	TLSConfig *tls.Config
+	// Timeout bounds each stage.
+	Timeout time.Duration
+}
+
+// Result is the outcome of one stage.
+type Result struct {
+	Stage    string
+	Status   string
+	Duration time.Duration
+	Detail   string
+}
+
+const (
+	Pass = "PASS"
+	Fail = "FAIL"
+	Skip = "SKIP"
+	Info = "INFO"
+)
+
+type stage struct {
+	name string
+	run  func(*diagnosis) (string, error)
+	// optional stages don't stop later stages when they fail
+	optional bool
+}
+
+var stages = []stage{
+	{name: "dns", run: (*diagnosis).dns},
+	{name: "proxy", run: (*diagnosis).proxy, optional: true},
+	{name: "tcp", run: (*diagnosis).tcp},
+	{name: "tls", run: (*diagnosis).tls},
+	{name: "ca-checksum", run: (*diagnosis).caChecksum, optional: true},
+	{name: "websocket", run: (*diagnosis).websocket, optional: true},
+	{name: "token", run: (*diagnosis).token},
+}
+
+type diagnosis struct {
+	Target
+	host   string
+	port   string
+	status int
+	body   string
+}
+
+// Run performs each stage of the connection against target, writing a line per
+// stage to out. It returns false if any stage failed.
+func Run(out io.Writer, target Target) bool {
+	ok := true
+	for _, result := range Stages(target) {
+		if result.Status == Fail {
+			ok = false
+		}
+		fmt.Fprintf(out, "%-4s  %-12s %8s  %s\n", result.Status, result.Stage,
+			result.Duration.Round(time.Millisecond), redact.String(result.Detail))
+	}
+	return ok
+}
+
+// Stages performs each stage of the connection against target. Once a required
+// stage fails the remaining stages are skipped.
+func Stages(target Target) []Result {
+	if target.Timeout <= 0 {
+		target.Timeout = DefaultTimeout
+	}
+
+	d := &diagnosis{
+		Target: target,
+		host:   target.Server.Hostname(),
+		port:   target.Server.Port(),
+	}
+	if d.port == "" {
+		d.port = "443"
+		if target.Server.Scheme == "http" {
+			d.port = "80"
+		}
+	}
+
+	var results []Result
+	failed := ""
+	for _, s := range stages {
+		if failed != "" {
+			results = append(results, Result{Stage: s.name, Status: Skip, Detail: failed + " failed"})
+			continue
+		}
+
+		start := time.Now()
+		detail, err := s.run(d)
+		result := Result{
+			Stage:    s.name,
+			Status:   Pass,
+			Duration: time.Since(start),
+			Detail:   detail,
+		}
+		if err == errSkipped {
+			result.Status = Skip
+		} else if err == errInfo {
+			result.Status = Info
+		} else if err != nil {
+			result.Status = Fail
+			result.Detail = err.Error()
+			if !s.optional {
+				failed = s.name
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+var (
+	errSkipped = fmt.Errorf("skipped")
+	errInfo    = fmt.Errorf("info")
+)
+
+func (d *diagnosis) dns() (string, error) {
+	if ip := net.ParseIP(d.host); ip != nil {
+		return fmt.Sprintf("%s is an IP address", d.host), nil
+	}
+
+	addrs, err := net.LookupHost(d.host)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s resolves to %s", d.host, strings.Join(addrs, ", ")), nil
+}
+
+func (d *diagnosis) proxy() (string, error) {
+	req := &http.Request{URL: d.Server}
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return "", err
+	}
+	if proxyURL == nil {
+		return "no proxy configured for " + d.host, errInfo
+	}
+	return fmt.Sprintf("environment sets proxy %s for %s, the tunnel connects directly and does not use it",
+		proxyURL.Host, d.host), errInfo
+}
+
+func (d *diagnosis) tcp() (string, error) {
+	address := net.JoinHostPort(d.host, d.port)
+	conn, err := net.DialTimeout("tcp", address, d.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return fmt.Sprintf("connected to %s (%s)", address, conn.RemoteAddr()), nil
+}
+
+func (d *diagnosis) tls() (string, error) {
+	if d.Server.Scheme != "https" {
+		return "server URL is not https", errSkipped
+	}
+
+	address := net.JoinHostPort(d.host, d.port)
+	config := d.tlsConfig()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: d.Timeout}, "tcp", address, config)
+	if err == nil {
+		defer conn.Close()
+		return describeChain(conn.ConnectionState().PeerCertificates), nil
+	}
+
+	// Fetch the chain without verification so the failure can be explained.
+	insecure := config.Clone()
+	insecure.InsecureSkipVerify = true
+	insecureConn, insecureErr := tls.DialWithDialer(&net.Dialer{Timeout: d.Timeout}, "tcp", address, insecure)
+	if insecureErr != nil {
+		return "", err
+	}
+	defer insecureConn.Close()
+	return "", fmt.Errorf("%v; %s", err, describeChain(insecureConn.ConnectionState().PeerCertificates))
+}
+
+func (d *diagnosis) caChecksum() (string, error) {
+	if d.CAChecksum == "" {
+		return "no CA checksum configured", errSkipped
+	}
+
+	cacerts, err := server.FetchCACerts(d.Server, d.tlsConfig(), d.Timeout)
+	if err != nil {
+		return "", err
+	}
+
+	actual := server.CAChecksum(cacerts)
+	if actual != d.CAChecksum {
+		return "", fmt.Errorf("checksum of the server CA certificates is %s, expected %s", actual, d.CAChecksum)
+	}
+	return "checksum matches " + actual, nil
+}
+
+func (d *diagnosis) websocket() (string, error) {
+	dialer := &websocket.Dialer{
+		TLSClientConfig:  d.TLSConfig,
+		HandshakeTimeout: d.Timeout,
+	}
+
+	headers := http.Header{}
+	for key, values := range d.Headers {
+		for _, value := range values {
+			headers.Add(key, value)
+		}
+	}
+	headers.Del(paramsHeader)
+
+	conn, resp, err := dialer.Dial(d.ConnectURL, headers)
+	if resp != nil {
+		d.status = resp.StatusCode
+		if resp.Body != nil {
+			d.body = readBody(resp.Body)
+		}
+	}
+	if err != nil {
+		if resp != nil {
+			return "", fmt.Errorf("upgrade of %s failed with HTTP %s: %s", d.ConnectURL, resp.Status, d.body)
+		}
+		return "", fmt.Errorf("upgrade of %s failed: %v", d.ConnectURL, err)
+	}
+	// Nothing is exchanged over the tunnel, the 101 is all the stage checks.
+	conn.Close()
+
+	return fmt.Sprintf("upgrade of %s returned HTTP %d", d.ConnectURL, d.status), nil
+}
+
+func (d *diagnosis) token() (string, error) {
+	switch d.status {
+	case 0:
+		return "no response to the upgrade request", errSkipped
+	case http.StatusSwitchingProtocols:
+		return "server accepted the token", nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("server rejected the token with HTTP %d: %s", d.status, d.body)
+	}
+	return "", fmt.Errorf("unable to verify the token, upgrade returned HTTP %d", d.status)
+}
+
+func (d *diagnosis) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if d.TLSConfig != nil {
+		config = d.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = d.host
+	}
+	return config
+}
+
+func describeChain(certs []*x509.Certificate) string {
+	var parts []string
+	for i, cert := range certs {
+		parts = append(parts, fmt.Sprintf("[%d] subject=%q issuer=%q expires=%s (%d days)",
+			i, certName(cert.Subject), certName(cert.Issuer),
+			cert.NotAfter.UTC().Format(time.RFC3339), int(time.Until(cert.NotAfter).Hours()/24)))
+	}
+	return "chain " + strings.Join(parts, " ")
+}
+
+func certName(name pkix.Name) string {
+	if name.CommonName != "" {
+		return name.CommonName
+	}
+	return strings.Join(name.Organization, ",")
+}
+
+func readBody(body io.Reader) string {
+	bytes, _ := ioutil.ReadAll(io.LimitReader(body, maxBodySize))
+	return strings.TrimSpace(string(bytes))
+}
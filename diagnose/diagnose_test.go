@@ -0,0 +1,183 @@
+package diagnose
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/agent/server"
+)
+
+const testToken = "token-abcde:0123456789abcdefghij0123456789"
+
+// newServer is a stand-in for Rancher: it publishes its CA certificate and
+// upgrades connect requests carrying testToken. Connect requests carrying
+// params would register the node, they are refused.
+func newServer() (*httptest.Server, string) {
+	var cacerts string
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/settings/cacerts", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{"value": cacerts})
+	})
+	mux.HandleFunc("/v3/connect", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-API-Tunnel-Token") != testToken {
+			http.Error(rw, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get(paramsHeader) != "" {
+			http.Error(rw, "diagnose registered the node", http.StatusBadRequest)
+			return
+		}
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	})
+
+	ts := httptest.NewTLSServer(mux)
+	cacerts = strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})))
+	return ts, cacerts
+}
+
+func newTarget(t *testing.T, ts *httptest.Server, token string) Target {
+	u, err := server.ParseURL(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	return Target{
+		Server:     u,
+		ConnectURL: server.ConnectURL(u),
+		Headers:    http.Header{"X-API-Tunnel-Token": {token}, paramsHeader: {"e30="}},
+		TLSConfig:  &tls.Config{RootCAs: pool},
+		Timeout:    5 * time.Second,
+	}
+}
+
+func statuses(results []Result) map[string]string {
+	status := map[string]string{}
+	for _, result := range results {
+		status[result.Stage] = result.Status
+	}
+	return status
+}
+
+func assertStatuses(t *testing.T, results []Result, expected map[string]string) {
+	t.Helper()
+	actual := statuses(results)
+	for stage, status := range expected {
+		if actual[stage] != status {
+			t.Errorf("stage %s is %s, expected %s; results: %+v", stage, actual[stage], status, results)
+		}
+	}
+}
+
+func TestStagesPass(t *testing.T) {
+	ts, cacerts := newServer()
+	defer ts.Close()
+
+	target := newTarget(t, ts, testToken)
+	target.CAChecksum = server.CAChecksum(cacerts)
+
+	assertStatuses(t, Stages(target), map[string]string{
+		"dns":         Pass,
+		"tcp":         Pass,
+		"tls":         Pass,
+		"ca-checksum": Pass,
+		"websocket":   Pass,
+		"token":       Pass,
+	})
+}
+
+func TestStagesRejectedToken(t *testing.T) {
+	ts, _ := newServer()
+	defer ts.Close()
+
+	results := Stages(newTarget(t, ts, "wrong"))
+	assertStatuses(t, results, map[string]string{
+		"tls":         Pass,
+		"ca-checksum": Skip,
+		"websocket":   Fail,
+		"token":       Fail,
+	})
+	for _, result := range results {
+		if result.Stage == "token" && !strings.Contains(result.Detail, "401") {
+			t.Errorf("token failure doesn't report the status: %s", result.Detail)
+		}
+	}
+}
+
+func TestStagesUntrustedCertificate(t *testing.T) {
+	ts, _ := newServer()
+	defer ts.Close()
+
+	target := newTarget(t, ts, testToken)
+	target.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+
+	results := Stages(target)
+	assertStatuses(t, results, map[string]string{
+		"tcp":         Pass,
+		"tls":         Fail,
+		"ca-checksum": Skip,
+		"websocket":   Skip,
+		"token":       Skip,
+	})
+	for _, result := range results {
+		if result.Stage == "tls" && !strings.Contains(result.Detail, "chain") {
+			t.Errorf("tls failure doesn't describe the chain: %s", result.Detail)
+		}
+	}
+}
+
+func TestStagesChecksumMismatch(t *testing.T) {
+	ts, _ := newServer()
+	defer ts.Close()
+
+	target := newTarget(t, ts, testToken)
+	target.CAChecksum = strings.Repeat("0", 64)
+
+	// The checksum stage is optional, the connection is still checked.
+	assertStatuses(t, Stages(target), map[string]string{
+		"ca-checksum": Fail,
+		"websocket":   Pass,
+		"token":       Pass,
+	})
+}
+
+func TestStagesUnreachable(t *testing.T) {
+	ts, _ := newServer()
+	target := newTarget(t, ts, testToken)
+	ts.Close()
+
+	assertStatuses(t, Stages(target), map[string]string{
+		"dns":   Pass,
+		"tcp":   Fail,
+		"tls":   Skip,
+		"token": Skip,
+	})
+}
+
+func TestStagesPlainHTTP(t *testing.T) {
+	ts, _ := newServer()
+	defer ts.Close()
+
+	target := newTarget(t, ts, testToken)
+	u, _ := url.Parse(strings.Replace(ts.URL, "https", "http", 1))
+	target.Server = u
+
+	assertStatuses(t, Stages(target), map[string]string{
+		"tls": Skip,
+	})
+}
@@ -0,0 +1,369 @@
+package dockerproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)*/`)
+
+// Policy decides which Docker Engine API requests the server may make. A
+// request that no rule allows is denied.
+type Policy struct {
+	// Rules allow requests by method and path.
+	Rules []Rule `json:"rules"`
+	// ContainerNames are patterns the names of containers the server creates,
+	// changes or removes must match. Empty allows any container.
+	ContainerNames []string `json:"containerNames"`
+	// Privileged are patterns of container names that may be created
+	// privileged, in host namespaces or those of other containers, without
+	// seccomp or AppArmor, with added capabilities or devices, with the
+	// volumes of other containers, or with host paths outside HostMounts.
+	// Other containers can't be renamed to match them.
+	Privileged []string `json:"privileged"`
+	// HostMounts are host paths, including everything below them, that any
+	// container or local volume may bind mount.
+	HostMounts []string `json:"hostMounts"`
+	// Exec restricts exec into containers.
+	Exec ExecPolicy `json:"exec"`
+}
+
+// Rule allows requests whose method and path match. Paths are matched
+// without the API version prefix, e.g. /containers/*/start, and a trailing
+// /** matches any number of segments.
+type Rule struct {
+	Methods []string `json:"methods"`
+	Paths   []string `json:"paths"`
+}
+
+// ExecPolicy restricts exec into containers.
+type ExecPolicy struct {
+	// Containers are patterns of container names exec is allowed in. Empty
+	// denies exec into any container.
+	Containers []string `json:"containers"`
+	// Commands are patterns the executable must match, empty allows any.
+	Commands []string `json:"commands"`
+	// Privileged allows privileged exec sessions.
+	Privileged bool `json:"privileged"`
+}
+
+// LoadPolicy reads a JSON or YAML policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read docker policy: %v", err)
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse docker policy %s: %v", file, err)
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(jsonData, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse docker policy %s: %v", file, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid docker policy %s: %v", file, err)
+	}
+	return policy, nil
+}
+
+func (p *Policy) validate() error {
+	var patterns []string
+	for i, rule := range p.Rules {
+		if len(rule.Methods) == 0 || len(rule.Paths) == 0 {
+			return fmt.Errorf("rule %d needs methods and paths", i+1)
+		}
+		patterns = append(patterns, rule.Paths...)
+	}
+	patterns = append(patterns, p.ContainerNames...)
+	patterns = append(patterns, p.Privileged...)
+	patterns = append(patterns, p.Exec.Containers...)
+	patterns = append(patterns, p.Exec.Commands...)
+	for _, pattern := range patterns {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	for _, mount := range p.HostMounts {
+		if !path.IsAbs(mount) {
+			return fmt.Errorf("host mount %q is not an absolute path", mount)
+		}
+	}
+	return nil
+}
+
+// apiPath returns the cleaned path without the API version prefix.
+func apiPath(p string) string {
+	p = path.Clean("/" + p)
+	if loc := versionPrefix.FindStringIndex(p + "/"); loc != nil {
+		p = path.Clean("/" + (p + "/")[loc[1]:])
+	}
+	return p
+}
+
+// matchPath matches p against patterns, where a trailing /** matches the
+// prefix and anything below it.
+func matchPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if !strings.HasSuffix(pattern, "/**") {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+			continue
+		}
+
+		prefix := strings.TrimSuffix(pattern, "/**")
+		if prefix == "" {
+			return true
+		}
+		want := strings.Split(strings.Trim(prefix, "/"), "/")
+		have := strings.Split(strings.Trim(p, "/"), "/")
+		if len(have) < len(want) {
+			continue
+		}
+		head := "/" + strings.Join(have[:len(want)], "/")
+		if ok, _ := path.Match(prefix, head); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowsRequest(method, apiPath string) bool {
+	for _, rule := range p.Rules {
+		if !contains(rule.Methods, method) {
+			continue
+		}
+		if matchPath(rule.Paths, apiPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowsContainer(name string) bool {
+	return len(p.ContainerNames) == 0 || matchAny(p.ContainerNames, name)
+}
+
+// checkCreate returns why a container may not be created, if it may not.
+func (p *Policy) checkCreate(name string, config *createConfig) error {
+	if !p.allowsContainer(name) {
+		if name == "" {
+			return fmt.Errorf("containers must be named to match %s", strings.Join(p.ContainerNames, ", "))
+		}
+		return fmt.Errorf("container name %q does not match %s", name, strings.Join(p.ContainerNames, ", "))
+	}
+	if matchAny(p.Privileged, name) {
+		return nil
+	}
+
+	host := config.HostConfig
+	switch {
+	case host.Privileged:
+		return fmt.Errorf("container %q may not be privileged", name)
+	case len(host.CapAdd) > 0:
+		return fmt.Errorf("container %q may not add capabilities", name)
+	case len(host.Devices) > 0:
+		return fmt.Errorf("container %q may not use host devices", name)
+	case len(host.VolumesFrom) > 0:
+		return fmt.Errorf("container %q may not use the volumes of other containers", name)
+	}
+	// Joining the namespaces of another container reaches the host if that
+	// container is privileged, so it is denied like the host namespaces.
+	for _, namespace := range []struct{ name, mode string }{
+		{"PID", host.PidMode},
+		{"network", host.NetworkMode},
+		{"IPC", host.IpcMode},
+		{"user", host.UsernsMode},
+		{"UTS", host.UTSMode},
+		{"cgroup", host.CgroupnsMode},
+	} {
+		if namespace.mode == "host" {
+			return fmt.Errorf("container %q may not use the host %s namespace", name, namespace.name)
+		}
+		if strings.HasPrefix(namespace.mode, "container:") {
+			return fmt.Errorf("container %q may not join the %s namespace of %s", name, namespace.name, namespace.mode)
+		}
+	}
+	for _, opt := range host.SecurityOpt {
+		if unconfined(opt) {
+			return fmt.Errorf("container %q may not use security option %s", name, opt)
+		}
+	}
+
+	for _, source := range config.hostPaths() {
+		if !p.allowsHostMount(source) {
+			return fmt.Errorf("container %q may not mount host path %s", name, source)
+		}
+	}
+	return nil
+}
+
+// checkRename returns why the container may not be renamed to target, if it
+// may not. A new name matching Privileged or Exec.Containers would grant the
+// container rights it was never checked for.
+func (p *Policy) checkRename(name, target string) error {
+	target = strings.TrimPrefix(target, "/")
+	switch {
+	case !p.allowsContainer(target):
+		return fmt.Errorf("container name %q does not match %s", target, strings.Join(p.ContainerNames, ", "))
+	case matchAny(p.Privileged, target) && !matchAny(p.Privileged, name):
+		return fmt.Errorf("container %q may not be renamed to privileged name %q", name, target)
+	case matchAny(p.Exec.Containers, target) && !matchAny(p.Exec.Containers, name):
+		return fmt.Errorf("container %q may not be renamed to %q, which exec is allowed into", name, target)
+	}
+	return nil
+}
+
+// checkVolume returns why a volume may not be created, if it may not.
+func (p *Policy) checkVolume(config *volumeConfig) error {
+	if source := localDevice(config.Driver, config.DriverOpts); source != "" && !p.allowsHostMount(source) {
+		return fmt.Errorf("volume %q may not mount host path %s", config.Name, source)
+	}
+	return nil
+}
+
+// unconfined returns whether a security option disables seccomp or AppArmor,
+// in the seccomp=unconfined or older seccomp:unconfined form.
+func unconfined(opt string) bool {
+	parts := strings.SplitN(opt, "=", 2)
+	if len(parts) != 2 {
+		parts = strings.SplitN(opt, ":", 2)
+	}
+	if len(parts) != 2 {
+		return false
+	}
+	return (parts[0] == "seccomp" || parts[0] == "apparmor") && parts[1] == "unconfined"
+}
+
+// localDevice returns the host path a local volume mounts, if it mounts one,
+// as with o=bind,device=/path or a block device.
+func localDevice(driver string, opts map[string]string) string {
+	if driver != "" && driver != "local" {
+		return ""
+	}
+	if device := opts["device"]; strings.HasPrefix(device, "/") {
+		return device
+	}
+	return ""
+}
+
+func (p *Policy) allowsHostMount(source string) bool {
+	source = path.Clean(source)
+	for _, mount := range p.HostMounts {
+		mount = path.Clean(mount)
+		if source == mount || mount == "/" || strings.HasPrefix(source, mount+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExec returns why an exec may not be created in the container, if it
+// may not.
+func (p *Policy) checkExec(name string, config *execConfig) error {
+	if !matchAny(p.Exec.Containers, name) {
+		return fmt.Errorf("exec into container %q is not allowed", name)
+	}
+	if config.Privileged && !p.Exec.Privileged {
+		return fmt.Errorf("privileged exec into container %q is not allowed", name)
+	}
+	if len(p.Exec.Commands) > 0 {
+		command := ""
+		if len(config.Cmd) > 0 {
+			command = config.Cmd[0]
+		}
+		if !matchAny(p.Exec.Commands, command) {
+			return fmt.Errorf("exec of %q is not allowed", command)
+		}
+	}
+	return nil
+}
+
+type createConfig struct {
+	Image      string
+	HostConfig struct {
+		Privileged   bool
+		PidMode      string
+		NetworkMode  string
+		IpcMode      string
+		UsernsMode   string
+		UTSMode      string
+		CgroupnsMode string
+		SecurityOpt  []string
+		CapAdd       []string
+		Devices      []json.RawMessage
+		VolumesFrom  []string
+		Binds        []string
+		Mounts       []struct {
+			Type          string
+			Source        string
+			VolumeOptions struct {
+				DriverConfig struct {
+					Name    string
+					Options map[string]string
+				}
+			}
+		}
+	}
+}
+
+// hostPaths returns the host paths the container mounts, including those of
+// local volumes it creates. Other named volumes are not host paths.
+func (c *createConfig) hostPaths() []string {
+	var paths []string
+	for _, bind := range c.HostConfig.Binds {
+		source := strings.SplitN(bind, ":", 2)[0]
+		if strings.HasPrefix(source, "/") {
+			paths = append(paths, source)
+		}
+	}
+	for _, mount := range c.HostConfig.Mounts {
+		switch mount.Type {
+		case "bind":
+			paths = append(paths, mount.Source)
+		case "volume":
+			driver := mount.VolumeOptions.DriverConfig
+			if device := localDevice(driver.Name, driver.Options); device != "" {
+				paths = append(paths, device)
+			}
+		}
+	}
+	return paths
+}
+
+type volumeConfig struct {
+	Name       string
+	Driver     string
+	DriverOpts map[string]string
+}
+
+type execConfig struct {
+	Privileged bool
+	Cmd        []string
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package dockerproxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var testPolicy = &Policy{
+	ContainerNames: []string{"rancher-*", "k8s_*"},
+	Privileged:     []string{"rancher-agent-*"},
+	HostMounts:     []string{"/var/lib/rancher", "/etc/kubernetes"},
+	Exec:           ExecPolicy{Containers: []string{"k8s_debug_*", "rancher-agent-*"}},
+}
+
+func TestCheckCreate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		config  string
+		allowed bool
+	}{
+		{"rancher-web", `{"Image": "nginx"}`, true},
+		{"other", `{"Image": "nginx"}`, false},
+		{"rancher-web", `{"HostConfig": {"Binds": ["/var/lib/rancher/data:/data", "cache:/cache"]}}`, true},
+		{"rancher-web", `{"HostConfig": {"Binds": ["/var/lib/rancher-other:/data"]}}`, false},
+		{"rancher-web", `{"HostConfig": {"Mounts": [{"Type": "bind", "Source": "/etc"}]}}`, false},
+		{"rancher-web", `{"HostConfig": {"Privileged": true}}`, false},
+		{"rancher-web", `{"HostConfig": {"PidMode": "host"}}`, false},
+		{"rancher-web", `{"HostConfig": {"NetworkMode": "host"}}`, false},
+		{"rancher-web", `{"HostConfig": {"NetworkMode": "bridge"}}`, true},
+		{"rancher-web", `{"HostConfig": {"IpcMode": "host"}}`, false},
+		{"rancher-web", `{"HostConfig": {"UsernsMode": "host"}}`, false},
+		{"rancher-web", `{"HostConfig": {"UTSMode": "host"}}`, false},
+		{"rancher-web", `{"HostConfig": {"CgroupnsMode": "host"}}`, false},
+		{"rancher-web", `{"HostConfig": {"CgroupnsMode": "private"}}`, true},
+		{"rancher-web", `{"HostConfig": {"PidMode": "container:rancher-agent-1"}}`, false},
+		{"rancher-web", `{"HostConfig": {"NetworkMode": "container:3f4e8a1b2c5d"}}`, false},
+		{"rancher-web", `{"HostConfig": {"IpcMode": "container:rancher-agent-1"}}`, false},
+		{"rancher-web", `{"HostConfig": {"IpcMode": "shareable"}}`, true},
+		{"rancher-agent-2", `{"HostConfig": {"PidMode": "container:rancher-agent-1"}}`, true},
+		{"rancher-web", `{"HostConfig": {"SecurityOpt": ["seccomp=unconfined"]}}`, false},
+		{"rancher-web", `{"HostConfig": {"SecurityOpt": ["seccomp:unconfined"]}}`, false},
+		{"rancher-web", `{"HostConfig": {"SecurityOpt": ["apparmor=unconfined"]}}`, false},
+		{"rancher-web", `{"HostConfig": {"SecurityOpt": ["no-new-privileges"]}}`, true},
+		{"rancher-web", `{"HostConfig": {"VolumesFrom": ["rancher-agent-1"]}}`, false},
+		{"rancher-web", `{"HostConfig": {"CapAdd": ["SYS_ADMIN"]}}`, false},
+		{"rancher-web", `{"HostConfig": {"Devices": [{"PathOnHost": "/dev/sda"}]}}`, false},
+		{"rancher-web", `{"HostConfig": {"Mounts": [{"Type": "volume", "Source": "data",
+			"VolumeOptions": {"DriverConfig": {"Options": {"type": "none", "o": "bind", "device": "/root"}}}}]}}`, false},
+		{"rancher-web", `{"HostConfig": {"Mounts": [{"Type": "volume", "Source": "data",
+			"VolumeOptions": {"DriverConfig": {"Options": {"type": "none", "o": "bind", "device": "/var/lib/rancher/data"}}}}]}}`, true},
+		{"rancher-agent-1", `{"HostConfig": {"Privileged": true, "NetworkMode": "host", "Binds": ["/:/host"]}}`, true},
+	} {
+		config := &createConfig{}
+		if err := json.Unmarshal([]byte(test.config), config); err != nil {
+			t.Fatal(err)
+		}
+		err := testPolicy.checkCreate(test.name, config)
+		if test.allowed && err != nil {
+			t.Errorf("%s %s: %v", test.name, test.config, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("%s %s was allowed", test.name, test.config)
+		}
+	}
+}
+
+func TestCheckRename(t *testing.T) {
+	for _, test := range []struct {
+		name, target string
+		allowed      bool
+	}{
+		{"rancher-web", "rancher-web-old", true},
+		{"rancher-web", "/rancher-web-old", true},
+		{"rancher-web", "other", false},
+		{"rancher-web", "rancher-agent-1", false},
+		{"rancher-web", "/rancher-agent-1", false},
+		{"k8s_web_pod", "k8s_debug_pod", false},
+		{"rancher-agent-1", "rancher-agent-old", true},
+		{"k8s_debug_pod", "k8s_debug_pod_old", true},
+		{"rancher-agent-1", "rancher-web", true},
+	} {
+		err := testPolicy.checkRename(test.name, test.target)
+		if test.allowed && err != nil {
+			t.Errorf("%s to %s: %v", test.name, test.target, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("renaming %s to %s was allowed", test.name, test.target)
+		}
+	}
+}
+
+func TestCheckVolume(t *testing.T) {
+	for _, test := range []struct {
+		config  string
+		allowed bool
+	}{
+		{`{"Name": "data"}`, true},
+		{`{"Name": "data", "DriverOpts": {"type": "none", "o": "bind", "device": "/etc"}}`, false},
+		{`{"Name": "data", "Driver": "local", "DriverOpts": {"type": "none", "o": "bind", "device": "/var/lib/rancher/data"}}`, true},
+		{`{"Name": "data", "DriverOpts": {"type": "ext4", "device": "/dev/sda1"}}`, false},
+		{`{"Name": "data", "DriverOpts": {"type": "nfs", "o": "addr=10.0.0.1", "device": ":/exports/data"}}`, true},
+		{`{"Name": "data", "Driver": "rexray", "DriverOpts": {"device": "/dev/xvdf"}}`, true},
+	} {
+		config := &volumeConfig{}
+		if err := json.Unmarshal([]byte(test.config), config); err != nil {
+			t.Fatal(err)
+		}
+		err := testPolicy.checkVolume(config)
+		if test.allowed && err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("%s was allowed", test.config)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package dockerproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/rancher/agent/audit"
+	"github.com/rancher/agent/runtimes"
+	"github.com/rancher/agent/tunnel"
+	"github.com/sirupsen/logrus"
+)
+
+const maxBodySize = 10 * 1024 * 1024
+
+// Proxy serves the Docker API on Socket to the server, forwarding only the
+// requests Policy allows.
+type Proxy struct {
+	Socket string
+	Policy *Policy
+}
+
+// Intercept is a tunnel.Interceptor serving connections to the socket.
+func (p *Proxy) Intercept(dest tunnel.Destination) (net.Conn, error) {
+	if dest.Proto != "unix" || dest.Address != p.Socket {
+		return nil, nil
+	}
+
+	tunnelEnd, proxyEnd := net.Pipe()
+	go p.serve(proxyEnd, dest)
+	return tunnelEnd, nil
+}
+
+func (p *Proxy) serve(conn net.Conn, dest tunnel.Destination) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				logrus.WithField("connection", dest.Connection).Debugf("Failed to read docker API request: %v", err)
+			}
+			return
+		}
+		if !p.handle(conn, reader, req, dest) {
+			return
+		}
+	}
+}
+
+// handle answers one request and returns whether the connection may be used
+// for another.
+func (p *Proxy) handle(conn net.Conn, reader *bufio.Reader, req *http.Request, dest tunnel.Destination) bool {
+	event := audit.Event{
+		Session:    dest.Session,
+		Connection: dest.Connection,
+		Proto:      dest.Proto,
+		Address:    dest.Address,
+		Request:    req.Method + " " + req.URL.RequestURI(),
+	}
+
+	if err := p.check(req); err != nil {
+		event.Reason = err.Error()
+		audit.Record(event)
+
+		// Read the body so the next request can be parsed.
+		n, _ := io.Copy(ioutil.Discard, io.LimitReader(req.Body, maxBodySize+1))
+		writeError(conn, req, http.StatusForbidden, "denied by agent policy: "+err.Error())
+		return n <= maxBodySize && !req.Close
+	}
+
+	event.Allowed = true
+	audit.Record(event)
+
+	backend, err := net.Dial("unix", p.Socket)
+	if err != nil {
+		writeError(conn, req, http.StatusBadGateway, err.Error())
+		return false
+	}
+	defer backend.Close()
+
+	if err := req.Write(backend); err != nil {
+		writeError(conn, req, http.StatusBadGateway, err.Error())
+		return false
+	}
+
+	backendReader := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(backendReader, req)
+	if err != nil {
+		writeError(conn, req, http.StatusBadGateway, err.Error())
+		return false
+	}
+	defer resp.Body.Close()
+
+	if hijacked(req, resp) {
+		writeHeader(conn, resp)
+		go func() {
+			io.Copy(backend, reader)
+			if unixConn, ok := backend.(*net.UnixConn); ok {
+				unixConn.CloseWrite()
+			}
+		}()
+		io.Copy(conn, backendReader)
+		return false
+	}
+
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+	return !req.Close && !resp.Close
+}
+
+// check returns why the policy denies req, if it does.
+func (p *Proxy) check(req *http.Request) error {
+	// The daemon must see the path the policy was checked against.
+	if req.URL.RawPath != "" || path.Clean(req.URL.Path) != req.URL.Path {
+		return fmt.Errorf("path %q is not canonical", req.URL.Path)
+	}
+
+	endpoint := apiPath(req.URL.Path)
+	if !p.Policy.allowsRequest(req.Method, endpoint) {
+		return fmt.Errorf("%s %s is not allowed", req.Method, endpoint)
+	}
+
+	parts := strings.Split(strings.Trim(endpoint, "/"), "/")
+	if len(parts) < 2 || req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return nil
+	}
+	if parts[0] == "volumes" && parts[1] == "create" {
+		config := &volumeConfig{}
+		if err := readJSON(req, config); err != nil {
+			return err
+		}
+		return p.Policy.checkVolume(config)
+	}
+	if parts[0] != "containers" {
+		return nil
+	}
+
+	switch {
+	case parts[1] == "create":
+		config := &createConfig{}
+		if err := readJSON(req, config); err != nil {
+			return err
+		}
+		return p.Policy.checkCreate(req.URL.Query().Get("name"), config)
+	case parts[1] == "prune":
+		if len(p.Policy.ContainerNames) > 0 {
+			return fmt.Errorf("pruning containers is not allowed when container names are restricted")
+		}
+		return nil
+	}
+
+	name, err := p.containerName(parts[1])
+	if err != nil {
+		return err
+	}
+	if len(parts) == 3 && parts[2] == "exec" {
+		config := &execConfig{}
+		if err := readJSON(req, config); err != nil {
+			return err
+		}
+		return p.Policy.checkExec(name, config)
+	}
+	if !p.Policy.allowsContainer(name) {
+		return fmt.Errorf("container %q does not match %s", name, strings.Join(p.Policy.ContainerNames, ", "))
+	}
+	if len(parts) == 3 && parts[2] == "rename" {
+		return p.Policy.checkRename(name, req.URL.Query().Get("name"))
+	}
+	return nil
+}
+
+// containerName resolves an ID or name to the container name.
+func (p *Proxy) containerName(id string) (string, error) {
+	resp, err := runtimes.HTTPClient(p.Socket).Get("http://localhost/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container %s: %v", id, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to inspect container %s: %s", id, resp.Status)
+	}
+
+	container := struct {
+		Name string
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&container); err != nil {
+		return "", fmt.Errorf("failed to inspect container %s: %v", id, err)
+	}
+	return strings.TrimPrefix(container.Name, "/"), nil
+}
+
+// readJSON decodes the body of req into value and replaces the body so it can
+// still be forwarded.
+func readJSON(req *http.Request, value interface{}) error {
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxBodySize {
+		return fmt.Errorf("request body is larger than %d bytes", maxBodySize)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("failed to parse request body: %v", err)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	req.TransferEncoding = nil
+	return nil
+}
+
+// hijacked returns whether the daemon switched the connection to a raw
+// stream, as it does for attach and exec start when asked to upgrade. Other
+// raw streams, such as logs, are ordinary responses.
+func hijacked(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	if resp.StatusCode != http.StatusOK || req.Method != http.MethodPost || req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	parts := strings.Split(strings.Trim(apiPath(req.URL.Path), "/"), "/")
+	if len(parts) != 3 {
+		return false
+	}
+	return parts[0] == "containers" && parts[2] == "attach" || parts[0] == "exec" && parts[2] == "start"
+}
+
+func writeHeader(w io.Writer, resp *http.Response) {
+	fmt.Fprintf(w, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.Write(w)
+	io.WriteString(w, "\r\n")
+}
+
+func writeError(w io.Writer, req *http.Request, code int, message string) {
+	body, _ := json.Marshal(map[string]string{"message": message})
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	resp.Write(w)
+}
@@ -0,0 +1,166 @@
+package dockerproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/agent/tunnel"
+)
+
+// newFakeDocker serves container logs as the daemon does, a chunked raw
+// stream, and renames of container web1 named rancher-web on a unix socket.
+func newFakeDocker(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "dockerproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.39/containers/rancher-web/logs", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("line 1\n"))
+		rw.(http.Flusher).Flush()
+		rw.Write([]byte("line 2\n"))
+	})
+	mux.HandleFunc("/containers/web1/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"Name": "/rancher-web"}`))
+	})
+	mux.HandleFunc("/v1.39/containers/web1/rename", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Listener.Close()
+	ts.Listener = l
+	ts.Start()
+	return socket, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProxyStreamsLogs(t *testing.T) {
+	socket, cleanup := newFakeDocker(t)
+	defer cleanup()
+
+	proxy := &Proxy{
+		Socket: socket,
+		Policy: &Policy{Rules: []Rule{{Methods: []string{"GET"}, Paths: []string{"/containers/*/logs"}}}},
+	}
+	conn, err := proxy.Intercept(tunnel.Destination{Proto: "unix", Address: socket})
+	if err != nil || conn == nil {
+		t.Fatalf("proxy did not intercept %s: %v", socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/v1.39/containers/rancher-web/logs?stdout=1", nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		if string(body) != "line 1\nline 2\n" {
+			t.Errorf("request %d: got logs %q", i+1, body)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/v1.39/containers/rancher-web/json", nil)
+	req.Write(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request denied by policy answered %s", resp.Status)
+	}
+}
+
+func TestProxyChecksRenameTarget(t *testing.T) {
+	socket, cleanup := newFakeDocker(t)
+	defer cleanup()
+
+	policy := *testPolicy
+	policy.Rules = []Rule{{Methods: []string{"POST"}, Paths: []string{"/containers/*/rename"}}}
+	proxy := &Proxy{Socket: socket, Policy: &policy}
+	conn, err := proxy.Intercept(tunnel.Destination{Proto: "unix", Address: socket})
+	if err != nil || conn == nil {
+		t.Fatalf("proxy did not intercept %s: %v", socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for target, expected := range map[string]int{
+		"rancher-web2":    http.StatusNoContent,
+		"rancher-agent-1": http.StatusForbidden,
+		"other":           http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/v1.39/containers/web1/rename?name="+target, nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("rename to %s answered %s, expected %d", target, resp.Status, expected)
+		}
+	}
+}
+
+func TestHijacked(t *testing.T) {
+	upgrade := http.Header{"Connection": {"Upgrade"}, "Upgrade": {"tcp"}}
+	for _, test := range []struct {
+		method, path string
+		header       http.Header
+		status       int
+		hijacked     bool
+	}{
+		{"POST", "/v1.39/containers/abc/attach", upgrade, http.StatusSwitchingProtocols, true},
+		{"POST", "/v1.39/containers/abc/attach", upgrade, http.StatusOK, true},
+		{"POST", "/exec/abc/start", upgrade, http.StatusOK, true},
+		{"POST", "/v1.39/containers/abc/attach", http.Header{}, http.StatusOK, false},
+		{"GET", "/v1.39/containers/abc/logs", http.Header{}, http.StatusOK, false},
+		{"POST", "/v1.39/containers/abc/attach", upgrade, http.StatusNotFound, false},
+	} {
+		req, err := http.NewRequest(test.method, "http://localhost"+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = test.header
+		resp := &http.Response{
+			StatusCode: test.status,
+			Header:     http.Header{"Content-Type": {"application/vnd.docker.raw-stream"}},
+		}
+		if hijacked(req, resp) != test.hijacked {
+			t.Errorf("%s %s with %v answered %d: hijacked should be %v", test.method, test.path, test.header, test.status, test.hijacked)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package facts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultDir     = "/etc/rancher/agent/facts.d"
+	DefaultTimeout = 10 * time.Second
+	DefaultMaxSize = 64 * 1024
+
+	maxKeys        = 64
+	maxValueLength = 1024
+)
+
+var (
+	namespaceRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9_]*[a-z0-9])?$`)
+	keyRegexp       = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?$`)
+
+	errTooLarge = errors.New("output too large")
+)
+
+// Options configure where external facts come from and how much they may cost.
+type Options struct {
+	// Dir holds executables to run and .json, .yaml or .yml files to read.
+	Dir string
+	// Timeout bounds the run time of each executable.
+	Timeout time.Duration
+	// MaxSize bounds the size of each file or executable output in bytes.
+	MaxSize int64
+}
+
+// Facts are the external facts keyed by namespace, which is the file name
+// without its extension.
+type Facts map[string]map[string]interface{}
+
+// Collect gathers facts from every source in opts.Dir. A missing directory
+// yields no facts. Invalid, slow or unreadable sources are skipped with a
+// warning and returned as errors, so one broken source doesn't keep the node
+// from registering.
+func Collect(opts Options) (Facts, []error) {
+	if opts.Dir == "" {
+		opts.Dir = DefaultDir
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+
+	files, err := ioutil.ReadDir(opts.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		logrus.Warnf("Skipping facts: %v", err)
+		return nil, []error{err}
+	}
+
+	result := Facts{}
+	sources := map[string]string{}
+	var skipped []error
+	skip := func(path string, err error) {
+		err = fmt.Errorf("facts from %s: %v", path, err)
+		logrus.Warnf("Skipping %v", err)
+		skipped = append(skipped, err)
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !file.Mode().IsRegular() {
+			continue
+		}
+
+		path := filepath.Join(opts.Dir, name)
+		namespace := strings.TrimSuffix(name, filepath.Ext(name))
+
+		var data []byte
+		switch {
+		case isDataFile(name):
+			data, err = readFile(path, opts.MaxSize)
+		case file.Mode()&0111 != 0:
+			data, err = runHook(path, opts.Timeout, opts.MaxSize)
+		default:
+			logrus.Debugf("Ignoring facts file %s, not executable and not JSON or YAML", path)
+			continue
+		}
+		if err != nil {
+			skip(path, err)
+			continue
+		}
+
+		if !namespaceRegexp.MatchString(namespace) {
+			skip(path, fmt.Errorf("invalid namespace %q, must match %s", namespace, namespaceRegexp))
+			continue
+		}
+		if other, ok := sources[namespace]; ok {
+			skip(path, fmt.Errorf("namespace %q already provided by %s", namespace, other))
+			continue
+		}
+
+		values, err := parse(data)
+		if err != nil {
+			skip(path, err)
+			continue
+		}
+
+		logrus.Infof("Loaded %d facts into namespace %s from %s", len(values), namespace, path)
+		sources[namespace] = path
+		result[namespace] = values
+	}
+
+	if len(result) == 0 {
+		return nil, skipped
+	}
+	return result, skipped
+}
+
+func isDataFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func readFile(path string, maxSize int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+func runHook(path string, timeout time.Duration, maxSize int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: maxSize}
+	stderr := &limitedBuffer{max: 4096, truncate: true}
+
+	// The output is read from pipes the agent owns, rather than through
+	// exec's copying, so children the hook leaves behind holding them open
+	// can't outlast the timeout.
+	stdoutRead, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdoutRead.Close()
+	stderrRead, stderrWrite, err := os.Pipe()
+	if err != nil {
+		stdoutWrite.Close()
+		return nil, err
+	}
+	defer stderrRead.Close()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout = stdoutWrite
+	cmd.Stderr = stderrWrite
+	err = cmd.Start()
+	stdoutWrite.Close()
+	stderrWrite.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	copied := make(chan struct{}, 2)
+	for _, c := range []struct {
+		to   io.Writer
+		from io.Reader
+	}{{stdout, stdoutRead}, {stderr, stderrRead}} {
+		go func(to io.Writer, from io.Reader) {
+			// Hide the ReadFrom of the embedded buffer, which ignores the limit.
+			if _, err := io.Copy(struct{ io.Writer }{to}, from); err == errTooLarge {
+				// Stop the hook rather than let it block writing.
+				cancel()
+			}
+			copied <- struct{}{}
+		}(c.to, c.from)
+	}
+
+	err = cmd.Wait()
+	for i := 0; i < 2 && ctx.Err() == nil; i++ {
+		select {
+		case <-copied:
+		case <-ctx.Done():
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+	if stdout.overflow {
+		return nil, fmt.Errorf("output is larger than %d bytes", maxSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// parse accepts a JSON or YAML object whose values are scalars or lists of scalars.
+func parse(data []byte) (map[string]interface{}, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(jsonData, &values); err != nil {
+		return nil, fmt.Errorf("must be an object of facts: %v", err)
+	}
+
+	if len(values) > maxKeys {
+		return nil, fmt.Errorf("has %d facts, at most %d are allowed", len(values), maxKeys)
+	}
+
+	for key, value := range values {
+		if !keyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid key %q, must match %s", key, keyRegexp)
+		}
+		if err := validateValue(value, true); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+
+	return values, nil
+}
+
+func validateValue(value interface{}, allowList bool) error {
+	switch v := value.(type) {
+	case string:
+		if len(v) > maxValueLength {
+			return fmt.Errorf("longer than %d characters", maxValueLength)
+		}
+	case float64, bool:
+	case []interface{}:
+		if !allowList {
+			return fmt.Errorf("nested lists are not allowed")
+		}
+		for _, item := range v {
+			if err := validateValue(item, false); err != nil {
+				return err
+			}
+		}
+	case nil:
+		return fmt.Errorf("null is not allowed")
+	default:
+		return fmt.Errorf("must be a string, number, boolean or list of those")
+	}
+	return nil
+}
+
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int64
+	truncate bool
+	overflow bool
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	remaining := l.max - int64(l.Len())
+	if int64(len(p)) > remaining {
+		l.overflow = true
+		if !l.truncate {
+			return 0, errTooLarge
+		}
+		l.Buffer.Write(p[:remaining])
+		return len(p), nil
+	}
+	return l.Buffer.Write(p)
+}
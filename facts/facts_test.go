@@ -0,0 +1,57 @@
+package facts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCollectSkipsBrokenSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "facts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]struct {
+		content string
+		mode    os.FileMode
+	}{
+		"site.yaml":    {"rack: r1\nzone: a\n", 0644},
+		"broken.json":  {"{not json", 0644},
+		"nested.json":  {`{"key": {"nested": true}}`, 0644},
+		"slow":         {"#!/bin/sh\nsleep 5\n", 0755},
+		"hook":         {"#!/bin/sh\necho '{\"kernel\": \"5.4\"}'\n", 0755},
+		"huge":         {"#!/bin/sh\nyes\n", 0755},
+		"notes.txt":    {"ignored", 0644},
+		".hidden.json": {"{}", 0644},
+	}
+	for name, file := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(file.content), file.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	facts, skipped := Collect(Options{Dir: dir, Timeout: 500 * time.Millisecond})
+
+	expected := Facts{
+		"site": {"rack": "r1", "zone": "a"},
+		"hook": {"kernel": "5.4"},
+	}
+	if !reflect.DeepEqual(facts, expected) {
+		t.Errorf("collected %v, expected %v", facts, expected)
+	}
+	if len(skipped) != 4 {
+		t.Errorf("skipped %v, expected broken.json, nested.json, huge and slow", skipped)
+	}
+}
+
+func TestCollectMissingDir(t *testing.T) {
+	facts, skipped := Collect(Options{Dir: "/nonexistent/facts.d"})
+	if facts != nil || skipped != nil {
+		t.Errorf("expected nothing from a missing directory, got %v, %v", facts, skipped)
+	}
+}
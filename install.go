@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/rancher/agent/install"
+	"github.com/rancher/agent/mode"
+	"github.com/rancher/agent/server"
+)
+
+var validRoles = map[string]bool{
+	"etcd":         true,
+	"controlplane": true,
+	"worker":       true,
+}
+
+func newInstallFlagSet(name string) (*flag.FlagSet, *install.Options) {
+	opts := &install.Options{Out: os.Stdout}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.BinDir, "bin-dir", install.DefaultBinDir, "directory the agent binary is installed to")
+	fs.StringVar(&opts.UnitDir, "unit-dir", install.DefaultUnitDir, "directory the systemd unit is installed to")
+	fs.StringVar(&opts.ConfigDir, "config-dir", install.DefaultConfigDir, "directory the environment file is written to")
+	fs.StringVar(&opts.StateDir, "state-dir", install.DefaultStateDir, "directory the agent keeps its state in")
+	return fs, opts
+}
+
+func installCommand(args []string) error {
+	fs, opts := newInstallFlagSet("install")
+	serverURL := fs.String("server", os.Getenv("CATTLE_SERVER"), "URL of the Rancher server")
+	token := fs.String("token", os.Getenv("CATTLE_TOKEN"), "registration token")
+	caChecksum := fs.String("ca-checksum", os.Getenv("CATTLE_CA_CHECKSUM"), "sha256 checksum of the server CA certificates to trust")
+	caBundle := fs.String("ca-bundle", os.Getenv("CATTLE_CA_BUNDLE"), "PEM file or directory of CA certificates to trust for the server")
+	roles := fs.String("roles", os.Getenv("CATTLE_ROLE"), "comma separated roles of the node: etcd, controlplane and worker")
+	address := fs.String("address", os.Getenv("CATTLE_ADDRESS"), "address of the node, the address of the default route if empty")
+	internalAddress := fs.String("internal-address", os.Getenv("CATTLE_INTERNAL_ADDRESS"), "internal address of the node")
+	nodeName := fs.String("node-name", os.Getenv("CATTLE_NODE_NAME"), "name of the node, the short hostname if empty")
+	noStart := fs.Bool("no-start", false, "enable the service without starting it")
+	fs.Parse(args)
+
+	if *serverURL == "" {
+		return fmt.Errorf("--server is required")
+	}
+	if _, err := server.ParseURL(*serverURL); err != nil {
+		return err
+	}
+	if *token == "" {
+		return fmt.Errorf("--token is required")
+	}
+
+	var roleList []string
+	for _, role := range strings.Split(*roles, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		if !validRoles[role] {
+			return fmt.Errorf("invalid role %q, must be etcd, controlplane or worker", role)
+		}
+		roleList = append(roleList, role)
+	}
+	if len(roleList) == 0 {
+		return fmt.Errorf("--roles is required")
+	}
+
+	if *address == "" {
+		detected, err := defaultRouteAddress()
+		if err != nil {
+			return fmt.Errorf("failed to detect the node address, set --address: %v", err)
+		}
+		*address = detected
+	}
+	if *nodeName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to read the hostname, set --node-name: %v", err)
+		}
+		*nodeName = strings.SplitN(hostname, ".", 2)[0]
+	}
+
+	opts.Env = map[string]string{
+		"CATTLE_MODE":      mode.Node,
+		"CATTLE_SERVER":    *serverURL,
+		"CATTLE_TOKEN":     *token,
+		"CATTLE_ROLE":      strings.Join(roleList, ","),
+		"CATTLE_ADDRESS":   *address,
+		"CATTLE_NODE_NAME": *nodeName,
+		"CATTLE_STATE_DIR": opts.StateDir,
+	}
+	optional := map[string]string{
+		"CATTLE_CA_CHECKSUM":      *caChecksum,
+		"CATTLE_CA_BUNDLE":        *caBundle,
+		"CATTLE_INTERNAL_ADDRESS": *internalAddress,
+	}
+	for key, value := range optional {
+		if value != "" {
+			opts.Env[key] = value
+		}
+	}
+	opts.Start = !*noStart
+
+	return install.Install(*opts)
+}
+
+func uninstallCommand(args []string) error {
+	fs, opts := newInstallFlagSet("uninstall")
+	fs.BoolVar(&opts.Purge, "purge", false, "also remove the state directory")
+	fs.Parse(args)
+
+	return install.Uninstall(*opts)
+}
+
+// defaultRouteAddress returns the local address used to reach the internet,
+// like `ip route get 8.8.8.8` does in run.sh. No packets are sent.
+func defaultRouteAddress() (string, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
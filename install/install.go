@@ -0,0 +1,349 @@
+package install
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	Name = "rancher-agent"
+
+	DefaultBinDir    = "/usr/local/bin"
+	DefaultUnitDir   = "/etc/systemd/system"
+	DefaultConfigDir = "/etc/rancher/agent"
+	DefaultStateDir  = "/var/lib/rancher/agent"
+
+	envFile = "agent.env"
+)
+
+var unitTemplate = template.Must(template.New("unit").Parse(`# Written by {{.Name}} install, changes are overwritten on the next install.
+[Unit]
+Description=Rancher agent
+Documentation=https://rancher.com/docs/
+Wants=network-online.target
+After=network-online.target docker.service containerd.service
+
+[Service]
+Type=notify
+EnvironmentFile={{.EnvFile}}
+ExecStart={{.Binary}} run
+Restart=always
+RestartSec=5s
+TimeoutStartSec=0
+WatchdogSec=60s
+KillMode=process
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// Options describe where the agent is installed and how it is configured.
+type Options struct {
+	// Binary is the agent binary to install, the running executable if empty.
+	Binary    string
+	BinDir    string
+	UnitDir   string
+	ConfigDir string
+	StateDir  string
+	// Env is written to the environment file read by the service.
+	Env map[string]string
+	// Start starts or restarts the service in addition to enabling it.
+	Start bool
+	// Purge removes the state directory on uninstall.
+	Purge bool
+	// Systemctl runs systemctl with args, nil runs the real systemctl.
+	Systemctl func(args ...string) error
+	// Out receives a line per action taken.
+	Out io.Writer
+}
+
+func (o *Options) defaults() error {
+	if o.Binary == "" {
+		binary, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find the agent binary: %v", err)
+		}
+		o.Binary = binary
+	}
+	if o.BinDir == "" {
+		o.BinDir = DefaultBinDir
+	}
+	if o.UnitDir == "" {
+		o.UnitDir = DefaultUnitDir
+	}
+	if o.ConfigDir == "" {
+		o.ConfigDir = DefaultConfigDir
+	}
+	if o.StateDir == "" {
+		o.StateDir = DefaultStateDir
+	}
+	if o.Systemctl == nil {
+		o.Systemctl = systemctl
+	}
+	if o.Out == nil {
+		o.Out = ioutil.Discard
+	}
+	return nil
+}
+
+func (o *Options) binaryPath() string {
+	return filepath.Join(o.BinDir, Name)
+}
+
+func (o *Options) unitPath() string {
+	return filepath.Join(o.UnitDir, Name+".service")
+}
+
+func (o *Options) envPath() string {
+	return filepath.Join(o.ConfigDir, envFile)
+}
+
+// Install installs the agent as a systemd service and enables it. Running it
+// again only changes what differs and restarts the service if it did.
+func Install(opts Options) error {
+	if err := opts.defaults(); err != nil {
+		return err
+	}
+
+	binaryChanged, err := installBinary(opts.Binary, opts.binaryPath(), opts.Out)
+	if err != nil {
+		return err
+	}
+
+	if err := mkdir(opts.ConfigDir, 0755, opts.Out); err != nil {
+		return err
+	}
+	if err := mkdir(opts.StateDir, 0700, opts.Out); err != nil {
+		return err
+	}
+	// The state directory holds credentials, tighten it if it already existed.
+	if err := os.Chmod(opts.StateDir, 0700); err != nil {
+		return err
+	}
+
+	envChanged, err := writeFile(opts.envPath(), envFileContent(opts.Env), 0600, opts.Out)
+	if err != nil {
+		return err
+	}
+
+	unit := &bytes.Buffer{}
+	err = unitTemplate.Execute(unit, map[string]string{
+		"Name":    Name,
+		"Binary":  opts.binaryPath(),
+		"EnvFile": opts.envPath(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := mkdir(opts.UnitDir, 0755, opts.Out); err != nil {
+		return err
+	}
+	unitChanged, err := writeFile(opts.unitPath(), unit.Bytes(), 0644, opts.Out)
+	if err != nil {
+		return err
+	}
+
+	if unitChanged {
+		if err := opts.Systemctl("daemon-reload"); err != nil {
+			return err
+		}
+	}
+	if err := opts.Systemctl("enable", Name+".service"); err != nil {
+		return err
+	}
+	fmt.Fprintf(opts.Out, "enabled %s.service\n", Name)
+
+	if !opts.Start {
+		return nil
+	}
+	if binaryChanged || envChanged || unitChanged {
+		if err := opts.Systemctl("try-restart", "--no-block", Name+".service"); err != nil {
+			return err
+		}
+	}
+	if err := opts.Systemctl("start", "--no-block", Name+".service"); err != nil {
+		return err
+	}
+	fmt.Fprintf(opts.Out, "started %s.service\n", Name)
+	return nil
+}
+
+// Uninstall stops and removes the service installed by Install. The state
+// directory is kept unless opts.Purge is set. Anything already removed is
+// skipped.
+func Uninstall(opts Options) error {
+	if err := opts.defaults(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(opts.unitPath()); err == nil {
+		if err := opts.Systemctl("disable", "--now", Name+".service"); err != nil {
+			return err
+		}
+		fmt.Fprintf(opts.Out, "stopped and disabled %s.service\n", Name)
+	}
+
+	unitRemoved, err := remove(opts.unitPath(), opts.Out)
+	if err != nil {
+		return err
+	}
+	if unitRemoved {
+		if err := opts.Systemctl("daemon-reload"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := remove(opts.envPath(), opts.Out); err != nil {
+		return err
+	}
+	// Only removed when empty, it may hold other configuration such as facts.
+	if err := os.Remove(opts.ConfigDir); err == nil {
+		fmt.Fprintf(opts.Out, "removed %s\n", opts.ConfigDir)
+	}
+
+	if _, err := remove(opts.binaryPath(), opts.Out); err != nil {
+		return err
+	}
+
+	if opts.Purge {
+		if _, err := os.Stat(opts.StateDir); err == nil {
+			if err := os.RemoveAll(opts.StateDir); err != nil {
+				return err
+			}
+			fmt.Fprintf(opts.Out, "removed %s\n", opts.StateDir)
+		}
+	} else if _, err := os.Stat(opts.StateDir); err == nil {
+		fmt.Fprintf(opts.Out, "kept %s, uninstall with --purge to remove it\n", opts.StateDir)
+	}
+
+	return nil
+}
+
+// envFileContent formats env for a systemd EnvironmentFile.
+func envFileContent(env map[string]string) []byte {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# Written by %s install, changes are overwritten on the next install.\n", Name)
+	for _, key := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(env[key])
+		fmt.Fprintf(buf, "%s=\"%s\"\n", key, value)
+	}
+	return buf.Bytes()
+}
+
+func installBinary(src, dst string, out io.Writer) (bool, error) {
+	if same, err := sameFile(src, dst); err != nil || same {
+		return false, err
+	}
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the agent binary: %v", err)
+	}
+	if err := mkdir(filepath.Dir(dst), 0755, out); err != nil {
+		return false, err
+	}
+	// Written next to the target and renamed, the old binary may be running.
+	return writeFile(dst, data, 0755, out)
+}
+
+func sameFile(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the agent binary: %v", err)
+	}
+	bInfo, err := os.Stat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(aInfo, bInfo), nil
+}
+
+func mkdir(dir string, mode os.FileMode, out io.Writer) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created %s\n", dir)
+		// MkdirAll is subject to the umask.
+		return os.Chmod(dir, mode)
+	} else if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s exists and is not a directory", dir)
+	}
+	return nil
+}
+
+// writeFile replaces path with data unless it already has that content and
+// mode, returning whether it changed.
+func writeFile(path string, data []byte, mode os.FileMode, out io.Writer) (bool, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm() == mode {
+		existing, err := ioutil.ReadFile(path)
+		if err == nil && bytes.Equal(existing, data) {
+			fmt.Fprintf(out, "unchanged %s\n", path)
+			return false, nil
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(out, "wrote %s\n", path)
+	return true, nil
+}
+
+func remove(path string, out io.Writer) (bool, error) {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(out, "removed %s\n", path)
+	return true, nil
+}
+
+func systemctl(args ...string) error {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return fmt.Errorf("systemd is not running on this host")
+	}
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
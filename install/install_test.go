@@ -0,0 +1,238 @@
+package install
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testInstall installs into a temporary directory and records the systemctl
+// calls instead of running them.
+type testInstall struct {
+	dir   string
+	calls []string
+	out   bytes.Buffer
+}
+
+func newTestInstall(t *testing.T) *testInstall {
+	dir, err := ioutil.TempDir("", "install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "agent"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &testInstall{dir: dir}
+}
+
+func (i *testInstall) options(env map[string]string) Options {
+	i.calls = nil
+	i.out.Reset()
+	return Options{
+		Binary:    filepath.Join(i.dir, "agent"),
+		BinDir:    filepath.Join(i.dir, "bin"),
+		UnitDir:   filepath.Join(i.dir, "systemd"),
+		ConfigDir: filepath.Join(i.dir, "config"),
+		StateDir:  filepath.Join(i.dir, "state"),
+		Env:       env,
+		Start:     true,
+		Systemctl: func(args ...string) error {
+			i.calls = append(i.calls, strings.Join(args, " "))
+			return nil
+		},
+		Out: &i.out,
+	}
+}
+
+func (i *testInstall) path(elem ...string) string {
+	return filepath.Join(append([]string{i.dir}, elem...)...)
+}
+
+func (i *testInstall) assertCalls(t *testing.T, expected ...string) {
+	t.Helper()
+	if strings.Join(i.calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("systemctl was called with %q, expected %q", i.calls, expected)
+	}
+}
+
+func assertMode(t *testing.T, path string, mode os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("%s has mode %s, expected %s", path, info.Mode().Perm(), mode)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+var testEnv = map[string]string{
+	"CATTLE_SERVER": "https://rancher.test",
+	"CATTLE_TOKEN":  `token "quoted"\nand a backslash \`,
+}
+
+func TestInstall(t *testing.T) {
+	i := newTestInstall(t)
+	defer os.RemoveAll(i.dir)
+
+	if err := Install(i.options(testEnv)); err != nil {
+		t.Fatal(err)
+	}
+	i.assertCalls(t, "daemon-reload", "enable rancher-agent.service", "try-restart --no-block rancher-agent.service", "start --no-block rancher-agent.service")
+
+	assertMode(t, i.path("bin", Name), 0755)
+	assertMode(t, i.path("config"), 0755)
+	assertMode(t, i.path("config", envFile), 0600)
+	assertMode(t, i.path("state"), 0700)
+	assertMode(t, i.path("systemd", Name+".service"), 0644)
+
+	env, err := ioutil.ReadFile(i.path("config", envFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Written by rancher-agent install, changes are overwritten on the next install.\n" +
+		"CATTLE_SERVER=\"https://rancher.test\"\n" +
+		`CATTLE_TOKEN="token \"quoted\"\\nand a backslash \\"` + "\n"
+	if string(env) != expected {
+		t.Errorf("env file is\n%s\nexpected\n%s", env, expected)
+	}
+
+	unit, err := ioutil.ReadFile(i.path("systemd", Name+".service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"ExecStart=" + i.path("bin", Name) + " run", "EnvironmentFile=" + i.path("config", envFile), "Type=notify"} {
+		if !strings.Contains(string(unit), line+"\n") {
+			t.Errorf("unit doesn't contain %q:\n%s", line, unit)
+		}
+	}
+}
+
+func TestInstallIdempotent(t *testing.T) {
+	i := newTestInstall(t)
+	defer os.RemoveAll(i.dir)
+
+	if err := Install(i.options(testEnv)); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := os.Stat(i.path("systemd", Name+".service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Install(i.options(testEnv)); err != nil {
+		t.Fatal(err)
+	}
+	i.assertCalls(t, "enable rancher-agent.service", "start --no-block rancher-agent.service")
+	if strings.Contains(i.out.String(), "wrote") || strings.Contains(i.out.String(), "created") {
+		t.Errorf("second install changed files:\n%s", i.out.String())
+	}
+	if again, err := os.Stat(i.path("systemd", Name+".service")); err != nil || !os.SameFile(unit, again) {
+		t.Errorf("unit was replaced by the second install: %v", err)
+	}
+
+	// A changed environment restarts the service without reloading systemd.
+	changed := map[string]string{"CATTLE_SERVER": "https://other.test"}
+	if err := Install(i.options(changed)); err != nil {
+		t.Fatal(err)
+	}
+	i.assertCalls(t, "enable rancher-agent.service", "try-restart --no-block rancher-agent.service", "start --no-block rancher-agent.service")
+}
+
+func TestInstallTightensModes(t *testing.T) {
+	i := newTestInstall(t)
+	defer os.RemoveAll(i.dir)
+
+	if err := os.Mkdir(i.path("state"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(i.path("config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(i.path("config", envFile), envFileContent(testEnv), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := i.options(testEnv)
+	opts.Start = false
+	if err := Install(opts); err != nil {
+		t.Fatal(err)
+	}
+	i.assertCalls(t, "daemon-reload", "enable rancher-agent.service")
+	assertMode(t, i.path("state"), 0700)
+	assertMode(t, i.path("config", envFile), 0600)
+}
+
+func TestUninstall(t *testing.T) {
+	i := newTestInstall(t)
+	defer os.RemoveAll(i.dir)
+
+	if err := Install(i.options(testEnv)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(i.path("state", "credential.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Uninstall(i.options(nil)); err != nil {
+		t.Fatal(err)
+	}
+	i.assertCalls(t, "disable --now rancher-agent.service", "daemon-reload")
+	for _, path := range []string{i.path("bin", Name), i.path("systemd", Name+".service"), i.path("config")} {
+		if exists(path) {
+			t.Errorf("%s was not removed", path)
+		}
+	}
+	if !exists(i.path("state", "credential.json")) {
+		t.Error("the state directory was removed without purge")
+	}
+	if !strings.Contains(i.out.String(), "uninstall with --purge to remove it") {
+		t.Errorf("uninstall doesn't mention the kept state:\n%s", i.out.String())
+	}
+
+	// Nothing is left to stop, only the state is removed.
+	opts := i.options(nil)
+	opts.Purge = true
+	if err := Uninstall(opts); err != nil {
+		t.Fatal(err)
+	}
+	i.assertCalls(t)
+	if exists(i.path("state")) {
+		t.Error("the state directory was not purged")
+	}
+	if !exists(i.path("agent")) {
+		t.Error("the source binary was removed")
+	}
+}
+
+func TestUninstallKeepsOtherConfig(t *testing.T) {
+	i := newTestInstall(t)
+	defer os.RemoveAll(i.dir)
+
+	if err := Install(i.options(testEnv)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(i.path("config", "facts.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := i.options(nil)
+	opts.Purge = true
+	if err := Uninstall(opts); err != nil {
+		t.Fatal(err)
+	}
+	if exists(i.path("config", envFile)) || !exists(i.path("config", "facts.json")) {
+		t.Error("uninstall should only remove the env file from the config directory")
+	}
+	if exists(i.path("state")) {
+		t.Error("the state directory was not purged")
+	}
+}
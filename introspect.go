@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/rancher/agent/introspect"
+	"github.com/rancher/agent/tunnel"
+	"github.com/sirupsen/logrus"
+)
+
+func newIntrospection(fs *flag.FlagSet, reg *registration, client *tunnel.Client) *introspect.Service {
+	return &introspect.Service{
+		Version: VERSION,
+		Mode:    reg.decision.Mode,
+		Reasons: reg.decision.Reasons,
+		Config:  flagConfig(fs),
+		Params:  reg.payload,
+		Client:  client,
+	}
+}
+
+// serveIntrospection answers introspect.Address within the agent and returns
+// the interceptor that routes the server's connections to it.
+func serveIntrospection(service *introspect.Service) tunnel.Interceptor {
+	listener := tunnel.NewListener("tcp", introspect.Address)
+	go func() {
+		if err := http.Serve(listener, service.Handler()); err != nil {
+			logrus.WithError(err).Error("Introspection service stopped")
+		}
+	}()
+	return listener.Intercept
+}
+
+// flagConfig returns the value of every flag.
+func flagConfig(fs *flag.FlagSet) map[string]string {
+	config := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
+	return config
+}
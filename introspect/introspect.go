@@ -0,0 +1,153 @@
+package introspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rancher/agent/logging"
+	"github.com/rancher/agent/params"
+	"github.com/rancher/agent/preflight"
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/tunnel"
+)
+
+// Address is the reserved tunnel destination the introspection service is
+// served on. It is never dialed, the agent answers it itself.
+const Address = "introspect." + tunnel.AgentDomain + ":80"
+
+// DefaultLogLines is how many log lines are returned unless asked otherwise.
+const DefaultLogLines = 100
+
+// Info is everything the agent reports about itself.
+type Info struct {
+	Version   string             `json:"version"`
+	Mode      string             `json:"mode"`
+	Reasons   []string           `json:"reasons,omitempty"`
+	Config    map[string]string  `json:"config"`
+	Params    *params.Payload    `json:"params,omitempty"`
+	Preflight []preflight.Result `json:"preflight"`
+	Tunnel    tunnel.Status      `json:"tunnel"`
+	Logs      []string           `json:"logs"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Service answers the server's questions about the agent. Config values and
+// the cluster token in Params are redacted before they are served.
+type Service struct {
+	Version string
+	Mode    string
+	Reasons []string
+	Config  map[string]string
+	Params  *params.Payload
+	Client  *tunnel.Client
+}
+
+// Handler returns the read only introspection API.
+func (s *Service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/info", s.get(func(req *http.Request) (interface{}, error) {
+		lines, err := logLines(req)
+		if err != nil {
+			return nil, err
+		}
+		return s.info(lines), nil
+	}))
+	mux.HandleFunc("/v1/version", s.get(func(*http.Request) (interface{}, error) {
+		return map[string]string{"version": s.Version}, nil
+	}))
+	mux.HandleFunc("/v1/config", s.get(func(*http.Request) (interface{}, error) {
+		return s.config(), nil
+	}))
+	mux.HandleFunc("/v1/params", s.get(func(*http.Request) (interface{}, error) {
+		return s.params(), nil
+	}))
+	mux.HandleFunc("/v1/preflight", s.get(func(*http.Request) (interface{}, error) {
+		return preflight.Results(), nil
+	}))
+	mux.HandleFunc("/v1/status", s.get(func(*http.Request) (interface{}, error) {
+		return s.Client.Status(), nil
+	}))
+	mux.HandleFunc("/v1/logs", s.get(func(req *http.Request) (interface{}, error) {
+		lines, err := logLines(req)
+		if err != nil {
+			return nil, err
+		}
+		return logging.Recent(lines), nil
+	}))
+	return mux
+}
+
+func (s *Service) info(lines int) Info {
+	return Info{
+		Version:   s.Version,
+		Mode:      s.Mode,
+		Reasons:   s.Reasons,
+		Config:    s.config(),
+		Params:    s.params(),
+		Preflight: preflight.Results(),
+		Tunnel:    s.Client.Status(),
+		Logs:      logging.Recent(lines),
+	}
+}
+
+func (s *Service) config() map[string]string {
+	config := map[string]string{}
+	for name, value := range s.Config {
+		config[name] = redact.String(value)
+	}
+	return config
+}
+
+func (s *Service) params() *params.Payload {
+	if s.Params == nil || s.Params.Cluster == nil {
+		return s.Params
+	}
+	payload := *s.Params
+	cluster := *payload.Cluster
+	cluster.Token = redact.Mask
+	payload.Cluster = &cluster
+	return &payload
+}
+
+func (s *Service) get(handler func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", req.Method))
+			return
+		}
+		obj, err := handler(req)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, obj)
+	}
+}
+
+// logLines reads the lines query parameter, 0 returns every line kept.
+func logLines(req *http.Request) (int, error) {
+	value := req.URL.Query().Get("lines")
+	if value == "" {
+		return DefaultLogLines, nil
+	}
+	lines, err := strconv.Atoi(value)
+	if err != nil || lines < 0 {
+		return 0, fmt.Errorf("invalid lines %q", value)
+	}
+	return lines, nil
+}
+
+func writeJSON(rw http.ResponseWriter, code int, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(obj)
+}
+
+func writeError(rw http.ResponseWriter, code int, err error) {
+	writeJSON(rw, code, errorResponse{Error: err.Error()})
+}
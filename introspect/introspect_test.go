@@ -0,0 +1,106 @@
+package introspect
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rancher/agent/params"
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/tunnel"
+)
+
+const (
+	registrationToken = "registrationtoken12345"
+	clusterToken      = "clustertoken12345"
+	dockerPassword    = "dockerpassword12345"
+)
+
+func newTestService() *Service {
+	// The agent registers its token as a secret once it has read it.
+	redact.AddSecret(registrationToken)
+	return &Service{
+		Version: "v2.0.0",
+		Mode:    "node",
+		Config: map[string]string{
+			"server": "https://rancher.test",
+			"token":  registrationToken,
+			"env":    "DOCKER_PASSWORD=" + dockerPassword,
+		},
+		Params: &params.Payload{
+			Version: params.Version,
+			Cluster: &params.Cluster{Address: "10.43.0.1:443", Token: clusterToken},
+		},
+		Client: &tunnel.Client{},
+	}
+}
+
+func get(t *testing.T, server *httptest.Server, path string) string {
+	t.Helper()
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s returned %d: %s", path, resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+func TestSecretsRedacted(t *testing.T) {
+	service := newTestService()
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+
+	for _, path := range []string{"/v1/config", "/v1/params", "/v1/info"} {
+		body := get(t, server, path)
+		for _, secret := range []string{registrationToken, clusterToken, dockerPassword} {
+			if strings.Contains(body, secret) {
+				t.Errorf("%s contains %q: %s", path, secret, body)
+			}
+		}
+	}
+
+	config := map[string]string{}
+	if err := json.Unmarshal([]byte(get(t, server, "/v1/config")), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["token"] != redact.Mask || config["server"] != "https://rancher.test" {
+		t.Errorf("config is %v", config)
+	}
+
+	payload := params.Payload{}
+	if err := json.Unmarshal([]byte(get(t, server, "/v1/params")), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Cluster == nil || payload.Cluster.Token != redact.Mask || payload.Cluster.Address != "10.43.0.1:443" {
+		t.Errorf("params are %+v", payload.Cluster)
+	}
+
+	// The service redacts copies, the values it was given are unchanged.
+	if service.Params.Cluster.Token != clusterToken || service.Config["token"] != registrationToken {
+		t.Error("redaction changed the service")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	server := httptest.NewServer(newTestService().Handler())
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/config", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rancher/agent/redact"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Options configure the agent log output.
+type Options struct {
+	Level  string
+	Format string
+}
+
+// recentLines is how many of the last log lines Recent can return.
+const recentLines = 500
+
+var (
+	fieldsLock sync.RWMutex
+	fields     = logrus.Fields{}
+
+	recentLock sync.Mutex
+	recent     = make([]string, 0, recentLines)
+	recentNext int
+)
+
+// Setup configures the level and format of the standard logrus logger and
+// adds the fields set with SetField to every entry.
+func Setup(opts Options) error {
+	level, err := logrus.ParseLevel(opts.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %v", opts.Level, err)
+	}
+
+	var inner logrus.Formatter
+	switch opts.Format {
+	case FormatText, "":
+		inner = &logrus.TextFormatter{}
+	case FormatJSON:
+		inner = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log format %q, must be %s or %s", opts.Format, FormatText, FormatJSON)
+	}
+
+	logrus.SetLevel(level)
+	logrus.SetFormatter(&formatter{inner: inner})
+	return nil
+}
+
+// SetLevel changes the log level at runtime.
+func SetLevel(level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+	logrus.SetLevel(parsed)
+	logrus.Infof("Log level set to %s", parsed)
+	return nil
+}
+
+// SetField adds key to every following log entry. An empty value removes it.
+func SetField(key string, value interface{}) {
+	fieldsLock.Lock()
+	defer fieldsLock.Unlock()
+
+	if value == nil || value == "" {
+		delete(fields, key)
+		return
+	}
+	fields[key] = value
+}
+
+// formatter adds the global fields to each entry and masks secrets in the
+// message and fields. The entry's data is copied rather than modified since
+// entries may be shared between goroutines.
+type formatter struct {
+	inner logrus.Formatter
+}
+
+func (f *formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	fieldsLock.RLock()
+	data := make(logrus.Fields, len(entry.Data)+len(fields))
+	for k, v := range fields {
+		data[k] = v
+	}
+	fieldsLock.RUnlock()
+
+	for k, v := range entry.Data {
+		switch value := v.(type) {
+		case string:
+			data[k] = redact.String(value)
+		case error:
+			data[k] = redact.String(value.Error())
+		default:
+			data[k] = v
+		}
+	}
+
+	redacted := *entry
+	redacted.Message = redact.String(entry.Message)
+	redacted.Data = data
+	line, err := f.inner.Format(&redacted)
+	if err == nil {
+		remember(line)
+	}
+	return line, err
+}
+
+// Recent returns up to n of the last log lines, oldest first. They are
+// redacted like the log output.
+func Recent(n int) []string {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+
+	lines := make([]string, 0, len(recent))
+	lines = append(lines, recent[recentNext:]...)
+	lines = append(lines, recent[:recentNext]...)
+	if n > 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func remember(line []byte) {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+
+	text := strings.TrimSuffix(string(line), "\n")
+	if len(recent) < recentLines {
+		recent = append(recent, text)
+		return
+	}
+	recent[recentNext] = text
+	recentNext = (recentNext + 1) % recentLines
+}
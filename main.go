@@ -3,15 +3,34 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/rancher/agent/admin"
+	"github.com/rancher/agent/audit"
 	"github.com/rancher/agent/cluster"
-	"github.com/rancher/agent/node"
-	"github.com/rancher/rancher/pkg/remotedialer"
+	"github.com/rancher/agent/credential"
+	"github.com/rancher/agent/dockerproxy"
+	"github.com/rancher/agent/install"
+	"github.com/rancher/agent/introspect"
+	"github.com/rancher/agent/logging"
+	"github.com/rancher/agent/mode"
+	_ "github.com/rancher/agent/node"
+	"github.com/rancher/agent/params"
+	"github.com/rancher/agent/preflight"
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/runtimes"
+	"github.com/rancher/agent/server"
+	"github.com/rancher/agent/tunnel"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,44 +39,238 @@ const (
 	Params = "X-API-Tunnel-Params"
 )
 
+// VERSION is set at build time.
+var VERSION = "dev"
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"run": {
+		usage: "connect to the server and serve the tunnel (default)",
+		run:   runCommand,
+	},
+	"diagnose": {
+		usage: "check each stage of the connection to the server without registering",
+		run:   diagnoseCommand,
+	},
+	"print-params": {
+		usage: "print the registration params and headers without connecting",
+		run:   printParamsCommand,
+	},
+	"status": {
+		usage: "show the state of the running agent",
+		run:   statusCommand,
+	},
+	"reconnect": {
+		usage: "make the running agent reconnect to the server",
+		run:   reconnectCommand,
+	},
+	"drain": {
+		usage: "make the running agent refuse new tunneled connections",
+		run:   drainCommand,
+	},
+	"resume": {
+		usage: "make the running agent accept new tunneled connections again",
+		run:   resumeCommand,
+	},
+	"install": {
+		usage: "install the agent as a systemd service on this host",
+		run:   installCommand,
+	},
+	"uninstall": {
+		usage: "stop and remove the agent systemd service",
+		run:   uninstallCommand,
+	},
+	"cleanup": {
+		usage: "remove Rancher and RKE containers, volumes, directories, interfaces and iptables chains from this node",
+		run:   cleanupCommand,
+	},
+	"support-bundle": {
+		usage: "collect the agent state, host facts and logs into a tar.gz for support",
+		run:   supportBundleCommand,
+	},
+	"log-level": {
+		usage: "show or change the log level of the running agent",
+		run:   logLevelCommand,
+	},
+}
+
 func main() {
-	if os.Getenv("CATTLE_DEBUG") == "true" || os.Getenv("RANCHER_DEBUG") == "true" {
-		logrus.SetLevel(logrus.DebugLevel)
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
 	}
 
-	if err := run(); err != nil {
-		log.Fatal(err)
+	if err := cmd.run(args); err != nil {
+		logrus.Fatal(err)
 	}
 }
 
-func getParams() (map[string]interface{}, error) {
-	if os.Getenv("CATTLE_CLUSTER") == "true" {
-		return cluster.Params()
+func printUsage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", name, commands[name].usage)
 	}
-	return node.Params(), nil
 }
 
-func getTokenAndURL() (string, string, error) {
-	if os.Getenv("CATTLE_CLUSTER") == "true" {
-		return cluster.TokenAndURL()
+func envOrDefault(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-	return node.TokenAndURL()
+	return def
 }
 
-func run() error {
-	params, err := getParams()
+// envDuration returns the duration in the environment variable key, or def
+// if it's unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
 	if err != nil {
+		logrus.Warnf("Ignoring invalid %s %q: %v", key, value, err)
+		return def
+	}
+	return d
+}
+
+type options struct {
+	mode string
+	log  logging.Options
+	tls  server.TLSOptions
+	// runtimeWait, if set, delays registration until the docker API answers,
+	// on nodes that have one.
+	runtimeWait *runtimes.WaitOptions
+}
+
+func defaultLogLevel() string {
+	if os.Getenv("CATTLE_DEBUG") == "true" || os.Getenv("RANCHER_DEBUG") == "true" {
+		return "debug"
+	}
+	return envOrDefault("CATTLE_LOG_LEVEL", "info")
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	opts := &options{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.mode, "mode", envOrDefault("CATTLE_MODE", mode.Auto), "agent mode: node, cluster or auto")
+	fs.StringVar(&opts.log.Level, "log-level", defaultLogLevel(), "log level: debug, info, warning or error")
+	fs.StringVar(&opts.log.Format, "log-format", envOrDefault("CATTLE_LOG_FORMAT", logging.FormatText), "log format: text or json")
+	fs.StringVar(&opts.tls.CABundle, "ca-bundle", os.Getenv("CATTLE_CA_BUNDLE"), "PEM file or directory of CA certificates to trust for the server")
+	fs.StringVar(&opts.tls.CAChecksum, "ca-checksum", os.Getenv("CATTLE_CA_CHECKSUM"), "sha256 checksum of the server CA certificates to trust")
+	fs.StringVar(&opts.tls.ServerName, "tls-server-name", os.Getenv("CATTLE_TLS_SERVER_NAME"), "name to verify the server certificate against")
+	fs.StringVar(&opts.tls.MinVersion, "tls-min-version", envOrDefault("CATTLE_TLS_MIN_VERSION", "1.2"), "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.BoolVar(&opts.tls.InsecureSkipVerify, "insecure-skip-verify", os.Getenv("CATTLE_INSECURE_SKIP_VERIFY") == "true", "do not verify the server certificate, for labs only")
+	return fs, opts
+}
+
+// parse parses the command line and configures logging before anything is logged.
+func parse(fs *flag.FlagSet, opts *options, args []string) error {
+	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	return logging.Setup(opts.log)
+}
 
-	bytes, err := json.Marshal(params)
+// waitForRuntime waits for the Docker API the server will drive: the socket
+// its docker requests are rewritten to, or the first Docker API found. Hosts
+// with only containerd or CRI-O have none, nothing is waited for there.
+func waitForRuntime(opts runtimes.WaitOptions) {
+	if opts.Socket == "" {
+		for _, runtime := range runtimes.Find() {
+			if runtime.DockerAPI() {
+				opts.Socket = runtime.Socket
+				break
+			}
+		}
+	}
+	if opts.Socket == "" {
+		logrus.Info("No Docker API socket found, not waiting for a container runtime")
+		return
+	}
+
+	runtime, err := runtimes.Wait(opts)
 	if err != nil {
-		return err
+		logrus.Warnf("Registering without a container runtime: %v", err)
+		preflight.Record("runtime-ready", preflight.Warn, err.Error())
+		return
+	}
+	preflight.Record("runtime-ready", preflight.Pass, fmt.Sprintf("%s %s answered at %s", runtime.Name, runtime.Version, runtime.Socket))
+}
+
+// registration is everything needed to connect to the server.
+type registration struct {
+	decision mode.Decision
+	payload  *params.Payload
+	token    string
+	server   *url.URL
+	wsURL    string
+	headers  http.Header
+}
+
+func resolve(opts *options) (*registration, error) {
+	// The server drives docker as soon as the tunnel is up, and the params
+	// report the runtime versions. Mode detection looks at the runtime
+	// sockets, so it runs once the runtime is up.
+	if opts.runtimeWait != nil && opts.mode != mode.Cluster {
+		waitForRuntime(*opts.runtimeWait)
 	}
 
-	token, server, err := getTokenAndURL()
+	decision, err := mode.Resolve(opts.mode)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	logging.SetField("mode", decision.Mode)
+	logrus.Infof("Using mode %s", decision)
+	preflight.Record("mode", preflight.Pass, decision.String())
+
+	provider, err := params.Get(decision.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	token, serverAddress, err := provider.TokenAndURL()
+	if err != nil {
+		return nil, err
+	}
+
+	redact.AddSecret(token)
+
+	serverURL, err := server.ParseURL(serverAddress)
+	if err != nil {
+		return nil, err
+	}
+	logging.SetField("server", serverURL.Host)
+
+	payload, err := provider.Params()
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.Node != nil {
+		logging.SetField("node", payload.Node.RequestedHostname)
+	}
+
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
 	}
 
 	headers := map[string][]string{
@@ -65,22 +278,304 @@ func run() error {
 		Params: {base64.StdEncoding.EncodeToString(bytes)},
 	}
 
-	serverURL, err := url.Parse(server)
+	return &registration{
+		decision: decision,
+		payload:  payload,
+		token:    token,
+		server:   serverURL,
+		wsURL:    server.ConnectURL(serverURL),
+		headers:  http.Header(headers),
+	}, nil
+}
+
+func runCommand(args []string) error {
+	fs, opts := newFlagSet("run")
+	adminSocket := fs.String("admin-socket", envOrDefault("CATTLE_ADMIN_SOCKET", admin.DefaultSocket), "path of the admin socket, empty to disable")
+	dial := dialFlags(fs)
+	rewrites := fs.String("rewrites", os.Getenv("CATTLE_REWRITES"), "comma separated proto:address=[proto:]address rewrites of tunneled destinations")
+	waitForRuntime := fs.Bool("wait-for-runtime", os.Getenv("CATTLE_WAIT_FOR_RUNTIME") != "false", "wait for the docker API to answer before connecting, on nodes with a docker API socket")
+	runtimeWaitTimeout := fs.Duration("runtime-wait-timeout", envDuration("CATTLE_RUNTIME_WAIT_TIMEOUT", runtimes.DefaultWaitTimeout), "how long to wait for the docker API before connecting anyway, 0 waits forever")
+	dockerPolicy := fs.String("docker-policy", os.Getenv("CATTLE_DOCKER_POLICY"), "JSON or YAML policy the server's docker API requests are filtered with, empty forwards them unfiltered")
+	auditLog := fs.String("audit-log", os.Getenv("CATTLE_AUDIT_LOG"), "file to append tunneled connection decisions to, the agent log if empty (allowed connections at debug level)")
+	nodeCredential := fs.Bool("node-credential", os.Getenv("CATTLE_NODE_CREDENTIAL") == "true", "in node mode, exchange the registration token for a credential of this node and connect with it, for servers that issue them")
+	stateDir := fs.String("state-dir", envOrDefault("CATTLE_STATE_DIR", install.DefaultStateDir), "directory the node credential is kept in, bind mount it from the host when running in a container")
+	serveIntrospect := fs.Bool("introspection", os.Getenv("CATTLE_INTROSPECTION") != "false", "let the server read the agent version, redacted config, facts, preflight results, connection stats and recent logs through the tunnel")
+	tracePayloads := fs.Bool("trace-payloads", os.Getenv("CATTLE_TRACE_PAYLOADS") == "true", "log tunneled data at debug level, may expose sensitive data")
+	if err := parse(fs, opts, args); err != nil {
+		return err
+	}
+
+	rewriteRules, err := tunnel.ParseRewrites(*rewrites)
+	if err != nil {
+		return err
+	}
+
+	if *waitForRuntime {
+		opts.runtimeWait = &runtimes.WaitOptions{
+			Timeout: *runtimeWaitTimeout,
+		}
+		// Wait for the socket the server's docker requests end up at.
+		for _, rule := range rewriteRules {
+			if rule.FromProto == "unix" && rule.From == runtimes.DockerSocket && rule.ToProto == "unix" {
+				opts.runtimeWait.Socket = rule.To
+			}
+		}
+	}
+
+	reg, err := resolve(opts)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := server.TLSConfig(reg.server, opts.tls)
 	if err != nil {
+		preflight.Record("tls", preflight.Fail, err.Error())
 		return err
 	}
+	preflight.Record("tls", preflight.Pass, "TLS configuration for "+reg.server.Host+" is valid")
 
-	wsURL := fmt.Sprintf("wss://%s/v3/connect", serverURL.Host)
-	logrus.Infof("Connecting to %s with token %s", wsURL, token)
-	remotedialer.ClientConnect(wsURL, http.Header(headers), nil, func(proto, address string) bool {
-		switch proto {
-		case "tcp":
+	var credentials *credential.Manager
+	if reg.decision.Mode == mode.Node && *nodeCredential {
+		credentials = credential.New(credential.Options{
+			Dir:               *stateDir,
+			Server:            reg.server,
+			TLSConfig:         tlsConfig,
+			RegistrationToken: reg.token,
+			Params:            reg.headers[Params][0],
+		})
+		token, err := credentials.Start()
+		if err != nil {
+			return err
+		}
+		reg.headers = withToken(reg.headers, token)
+	}
+
+	dialOpts, err := dial.resolve()
+	if err != nil {
+		return err
+	}
+	// Only runtime sockets may be dialed, and those rewritten to, which were
+	// chosen by the operator. Runtimes are looked up on each dial, so one that
+	// starts after the agent can be reached.
+	rewriteTargets := map[string]bool{}
+	for _, rule := range rewriteRules {
+		logrus.Infof("Rewriting %s/%s to %s/%s", rule.FromProto, rule.From, rule.ToProto, rule.To)
+		if rule.ToProto == "unix" {
+			rewriteTargets[rule.To] = true
+		}
+	}
+	authorizeSocket := func(socket string) bool {
+		if rewriteTargets[socket] {
 			return true
-		case "unix":
-			return address == "/var/run/docker.sock"
 		}
-		return false
+		_, ok := runtimes.Found(socket)
+		return ok
+	}
+
+	if err := audit.SetOutput(*auditLog); err != nil {
+		return err
+	}
+
+	var interceptors []tunnel.Interceptor
+	if reg.payload.Cluster != nil && reg.payload.Cluster.Proxy {
+		handler, err := cluster.NewProxy()
+		if err != nil {
+			return err
+		}
+		listener := tunnel.NewListener("tcp", cluster.ProxyAddress)
+		go func() {
+			if err := http.Serve(listener, handler); err != nil {
+				logrus.WithError(err).Error("Kubernetes API proxy stopped")
+			}
+		}()
+		interceptors = append(interceptors, listener.Intercept)
+	}
+	if *dockerPolicy != "" {
+		policy, err := dockerproxy.LoadPolicy(*dockerPolicy)
+		if err != nil {
+			return err
+		}
+		// Every socket the server may dial is filtered, unless it is a
+		// runtime without a Docker API, so rewrite targets the agent knows
+		// nothing about and runtimes started later don't bypass the policy.
+		notDocker := func(socket string) bool {
+			runtime, ok := runtimes.Found(socket)
+			return ok && !runtime.DockerAPI()
+		}
+		for _, rule := range rewriteRules {
+			if rule.FromProto == "unix" && rule.ToProto != "unix" && !notDocker(rule.From) {
+				return fmt.Errorf("docker policy %s can't filter unix:%s rewritten to %s:%s, only unix sockets are filtered",
+					*dockerPolicy, rule.From, rule.ToProto, rule.To)
+			}
+		}
+
+		logrus.Infof("Filtering docker API requests with policy %s", *dockerPolicy)
+		interceptors = append(interceptors, func(dest tunnel.Destination) (net.Conn, error) {
+			if dest.Proto != "unix" || notDocker(dest.Address) {
+				return nil, nil
+			}
+			proxy := &dockerproxy.Proxy{Socket: dest.Address, Policy: policy}
+			return proxy.Intercept(dest)
+		})
+	}
+
+	if *tracePayloads {
+		logrus.Warn("Tracing of tunneled payloads is enabled, debug logs may contain sensitive data")
+	}
+
+	logrus.Infof("Connecting to %s", reg.wsURL)
+	client := &tunnel.Client{
+		URL:           reg.wsURL,
+		Headers:       reg.headers,
+		TLSConfig:     tlsConfig,
+		TracePayloads: *tracePayloads,
+		Dial:          dialOpts,
+		Rewrites:      rewriteRules,
+		Interceptors:  interceptors,
+		Authorizer: func(proto, address string) bool {
+			switch proto {
+			case "tcp":
+				return true
+			case "unix":
+				return authorizeSocket(address)
+			}
+			return false
+		},
+	}
+
+	introspection := newIntrospection(fs, reg, client)
+	if *serveIntrospect {
+		client.Interceptors = append(client.Interceptors, serveIntrospection(introspection))
+		logrus.Infof("Serving introspection on tunnel address %s", introspect.Address)
+	}
+
+	if *adminSocket != "" {
+		adminServer := &admin.Server{
+			Path:    *adminSocket,
+			Version: VERSION,
+			Mode:    reg.decision.Mode,
+			Client:  client,
+			// The admin socket is root only, so it always serves
+			// introspection, for support bundles.
+			Introspect: introspection.Handler(),
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil {
+				logrus.WithError(err).Error("Admin API stopped")
+			}
+		}()
+	}
+
+	notifySystemd(client)
+	go handleDrainSignals(client)
+	if credentials == nil {
+		client.Run()
+		return nil
+	}
+
+	client.OnRejected = func(headers http.Header) {
+		if token := headers[Token]; len(token) > 0 {
+			credentials.Rejected(token[0])
+		}
+	}
+	go credentials.Run(func(token string) {
+		client.SetHeaders(withToken(reg.headers, token))
 	})
+	go client.Run()
+	// A revoked node stops instead of connecting with the registration token.
+	<-credentials.Revoked()
+	return credentials.Err()
+}
+
+// withToken returns a copy of headers with token as the tunnel token.
+func withToken(headers http.Header, token string) http.Header {
+	copied := http.Header{}
+	for k, v := range headers {
+		copied[k] = v
+	}
+	copied[Token] = []string{token}
+	return copied
+}
+
+type dialOptions struct {
+	tunnel.DialOptions
+	source      string
+	sourceRules string
+}
+
+func dialFlags(fs *flag.FlagSet) *dialOptions {
+	opts := &dialOptions{}
+	fs.DurationVar(&opts.Timeout, "dial-timeout", envDuration("CATTLE_DIAL_TIMEOUT", tunnel.DefaultDialTimeout), "timeout of tunneled dials the server sets no deadline for")
+	fs.DurationVar(&opts.MaxTimeout, "max-dial-timeout", envDuration("CATTLE_MAX_DIAL_TIMEOUT", tunnel.DefaultMaxDialTimeout), "maximum timeout of tunneled dials, caps the deadline set by the server")
+	fs.DurationVar(&opts.KeepAlive, "tcp-keepalive", envDuration("CATTLE_TCP_KEEPALIVE", tunnel.DefaultKeepAlive), "TCP keepalive period of tunneled connections, negative disables keepalives")
+	fs.DurationVar(&opts.IdleTimeout, "idle-timeout", envDuration("CATTLE_IDLE_TIMEOUT", 0), "close tunneled connections without traffic for this long, 0 never closes them")
+	fs.StringVar(&opts.source, "source-address", os.Getenv("CATTLE_SOURCE_ADDRESS"), "local address of tunneled TCP dials: an IP, internal for the internal address, or auto")
+	fs.StringVar(&opts.sourceRules, "source-address-rules", os.Getenv("CATTLE_SOURCE_ADDRESS_RULES"), "comma separated CIDR=address overrides of --source-address by destination")
+	return opts
+}
+
+// resolve parses the source address settings, "internal" refers to the
+// internal address of the node.
+func (o *dialOptions) resolve() (tunnel.DialOptions, error) {
+	internal := os.Getenv("CATTLE_INTERNAL_ADDRESS")
+
+	source, err := tunnel.ParseSourceAddress(o.source, internal)
+	if err != nil {
+		return o.DialOptions, err
+	}
+	rules, err := tunnel.ParseSourceRules(o.sourceRules, internal)
+	if err != nil {
+		return o.DialOptions, err
+	}
+
+	o.Source = source
+	o.SourceRules = rules
+
+	addresses := []net.IP{source}
+	for _, rule := range rules {
+		logrus.Infof("Dialing %s from %s", rule.Network, sourceName(rule.Address))
+		addresses = append(addresses, rule.Address)
+	}
+	if source != nil {
+		logrus.Infof("Dialing from %s", source)
+	}
+	for _, address := range addresses {
+		if address != nil && !isLocalAddress(address) {
+			logrus.Warnf("Source address %s is not assigned to this host, tunneled dials from it will fail", address)
+		}
+	}
+	return o.DialOptions, nil
+}
 
-	return nil
+func sourceName(ip net.IP) string {
+	if ip == nil {
+		return tunnel.SourceAuto
+	}
+	return ip.String()
+}
+
+func isLocalAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDrainSignals drains on SIGUSR1 and resumes on SIGUSR2.
+func handleDrainSignals(client *tunnel.Client) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range signals {
+		if sig == syscall.SIGUSR1 {
+			client.Drain()
+		} else {
+			client.Resume()
+		}
+	}
 }
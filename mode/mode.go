@@ -0,0 +1,142 @@
+package mode
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rancher/agent/runtimes"
+)
+
+const (
+	Auto    = "auto"
+	Node    = "node"
+	Cluster = "cluster"
+
+	serviceAccountTokenFile  = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	rancherCredentialsFolder = "/cattle-credentials"
+
+	kubernetesServiceHostKey = "KUBERNETES_SERVICE_HOST"
+	kubernetesServicePortKey = "KUBERNETES_SERVICE_PORT"
+)
+
+// Decision is the mode the agent runs in and the reasons it was chosen.
+type Decision struct {
+	Mode    string
+	Reasons []string
+}
+
+func (d Decision) String() string {
+	return fmt.Sprintf("%s (%s)", d.Mode, strings.Join(d.Reasons, "; "))
+}
+
+// Resolve turns the requested mode into a Decision, detecting the environment for auto.
+func Resolve(requested string) (Decision, error) {
+	switch requested {
+	case Node, Cluster:
+		return Decision{
+			Mode:    requested,
+			Reasons: []string{"requested with --mode=" + requested},
+		}, nil
+	case Auto, "":
+		// As before --mode existed, CATTLE_CLUSTER=true means cluster mode
+		// and any other value node mode; detection only runs if it is unset.
+		switch value := os.Getenv("CATTLE_CLUSTER"); value {
+		case "":
+			return Detect(currentSignals())
+		case "true":
+			return Decision{
+				Mode:    Cluster,
+				Reasons: []string{"CATTLE_CLUSTER=true"},
+			}, nil
+		default:
+			return Decision{
+				Mode:    Node,
+				Reasons: []string{"CATTLE_CLUSTER=" + value},
+			}, nil
+		}
+	}
+	return Decision{}, fmt.Errorf("invalid mode %q, must be one of %s, %s or %s", requested, Node, Cluster, Auto)
+}
+
+// Signals are the facts about the environment that mode detection is based on.
+type Signals struct {
+	ServiceAccount     bool
+	ServiceEnv         bool
+	RancherCredentials bool
+	// RuntimeSocket is the first container runtime socket found, if any.
+	RuntimeSocket string
+}
+
+func currentSignals() Signals {
+	return Signals{
+		ServiceAccount:     exists(serviceAccountTokenFile),
+		ServiceEnv:         os.Getenv(kubernetesServiceHostKey) != "" && os.Getenv(kubernetesServicePortKey) != "",
+		RancherCredentials: exists(rancherCredentialsFolder),
+		RuntimeSocket:      runtimeSocket(),
+	}
+}
+
+func runtimeSocket() string {
+	found := runtimes.Find()
+	if len(found) == 0 {
+		return ""
+	}
+	return found[0].Socket
+}
+
+// Detect decides between node and cluster mode. Cluster mode needs the Rancher
+// credentials inside a pod; node mode needs a container runtime socket. Having
+// both, or only half of the cluster signals, is reported as an error.
+func Detect(s Signals) (Decision, error) {
+	var clusterReasons, nodeReasons []string
+	if s.ServiceAccount {
+		clusterReasons = append(clusterReasons, "service account token mounted at "+serviceAccountTokenFile)
+	}
+	if s.ServiceEnv {
+		clusterReasons = append(clusterReasons, kubernetesServiceHostKey+" and "+kubernetesServicePortKey+" are set")
+	}
+	if s.RancherCredentials {
+		clusterReasons = append(clusterReasons, rancherCredentialsFolder+" exists")
+	}
+	if s.RuntimeSocket != "" {
+		nodeReasons = append(nodeReasons, s.RuntimeSocket+" exists")
+	}
+
+	inCluster := s.ServiceAccount && s.ServiceEnv
+
+	switch {
+	case s.RancherCredentials && s.RuntimeSocket != "":
+		return Decision{}, fmt.Errorf("contradictory signals for mode detection: %s, but %s; set --mode explicitly",
+			strings.Join(clusterReasons, ", "), strings.Join(nodeReasons, ", "))
+	case s.RancherCredentials && !inCluster:
+		return Decision{}, fmt.Errorf("%s exists but the agent is not running in a pod (%s); set --mode explicitly",
+			rancherCredentialsFolder, missingClusterSignals(s))
+	case s.RancherCredentials:
+		return Decision{Mode: Cluster, Reasons: clusterReasons}, nil
+	case s.RuntimeSocket != "":
+		if inCluster {
+			nodeReasons = append(nodeReasons, "running in a pod without "+rancherCredentialsFolder)
+		}
+		return Decision{Mode: Node, Reasons: nodeReasons}, nil
+	}
+
+	return Decision{}, fmt.Errorf("unable to detect mode: no container runtime socket such as %s and no %s; bind mount the runtime socket or set --mode explicitly",
+		runtimes.DockerSocket, rancherCredentialsFolder)
+}
+
+func missingClusterSignals(s Signals) string {
+	var missing []string
+	if !s.ServiceAccount {
+		missing = append(missing, "no service account token")
+	}
+	if !s.ServiceEnv {
+		missing = append(missing, kubernetesServiceHostKey+" or "+kubernetesServicePortKey+" not set")
+	}
+	return strings.Join(missing, ", ")
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
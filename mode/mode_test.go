@@ -0,0 +1,73 @@
+package mode
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	pod := Signals{ServiceAccount: true, ServiceEnv: true}
+	for _, test := range []struct {
+		name     string
+		signals  Signals
+		mode     string
+		expected string
+	}{
+		{"node", Signals{RuntimeSocket: "/var/run/docker.sock"}, Node, "/var/run/docker.sock exists"},
+		{"cluster", Signals{ServiceAccount: true, ServiceEnv: true, RancherCredentials: true}, Cluster, "/cattle-credentials exists"},
+		{"node in a pod", Signals{ServiceAccount: true, ServiceEnv: true, RuntimeSocket: "/run/containerd/containerd.sock"}, Node, "running in a pod without /cattle-credentials"},
+		{"contradictory", Signals{ServiceAccount: true, ServiceEnv: true, RancherCredentials: true, RuntimeSocket: "/var/run/docker.sock"}, "", "contradictory signals"},
+		{"credentials outside a pod", Signals{RancherCredentials: true}, "", "no service account token, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set"},
+		{"credentials without the service env", Signals{ServiceAccount: true, RancherCredentials: true}, "", "(KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set)"},
+		{"pod without credentials or socket", pod, "", "unable to detect mode"},
+		{"nothing", Signals{}, "", "unable to detect mode"},
+	} {
+		decision, err := Detect(test.signals)
+		if test.mode == "" {
+			if err == nil {
+				t.Errorf("%s: detected %s, expected an error", test.name, decision)
+			} else if !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("%s: %q does not contain %q", test.name, err, test.expected)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if decision.Mode != test.mode || !strings.Contains(decision.String(), test.expected) {
+			t.Errorf("%s: detected %s, expected %s because %s", test.name, decision, test.mode, test.expected)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	defer os.Setenv("CATTLE_CLUSTER", os.Getenv("CATTLE_CLUSTER"))
+
+	for _, test := range []struct {
+		requested, cattleCluster string
+		mode, reason             string
+	}{
+		{Node, "true", Node, "requested with --mode=node"},
+		{Cluster, "false", Cluster, "requested with --mode=cluster"},
+		{Auto, "true", Cluster, "CATTLE_CLUSTER=true"},
+		{Auto, "false", Node, "CATTLE_CLUSTER=false"},
+		{"", "false", Node, "CATTLE_CLUSTER=false"},
+		{"", "1", Node, "CATTLE_CLUSTER=1"},
+	} {
+		os.Setenv("CATTLE_CLUSTER", test.cattleCluster)
+		decision, err := Resolve(test.requested)
+		if err != nil {
+			t.Errorf("%q with CATTLE_CLUSTER=%s: %v", test.requested, test.cattleCluster, err)
+			continue
+		}
+		if decision.Mode != test.mode || strings.Join(decision.Reasons, "; ") != test.reason {
+			t.Errorf("%q with CATTLE_CLUSTER=%s: got %s, expected %s (%s)", test.requested, test.cattleCluster, decision, test.mode, test.reason)
+		}
+	}
+
+	if _, err := Resolve("kubernetes"); err == nil {
+		t.Error("an invalid mode was resolved")
+	}
+}
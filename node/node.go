@@ -1,44 +1,128 @@
 package node
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/rancher/agent/facts"
+	"github.com/rancher/agent/mode"
+	"github.com/rancher/agent/params"
+	"github.com/rancher/agent/preflight"
+	"github.com/rancher/agent/runtimes"
 	"github.com/rancher/norman/types/slice"
 	"github.com/sirupsen/logrus"
 )
 
+func init() {
+	params.Register(mode.Node, Provider{})
+}
+
+// Provider builds the registration params for a custom node.
+type Provider struct{}
+
+func (Provider) TokenAndURL() (string, string, error) {
+	return TokenAndURL()
+}
+
+func (Provider) Params() (*params.Payload, error) {
+	return Params()
+}
+
 func TokenAndURL() (string, string, error) {
 	return os.Getenv("CATTLE_TOKEN"), os.Getenv("CATTLE_SERVER"), nil
 }
 
-func Params() map[string]interface{} {
+func Params() (*params.Payload, error) {
 	roles := split(os.Getenv("CATTLE_ROLE"))
-	params := map[string]interface{}{
-		"customConfig": map[string]interface{}{
-			"address":         os.Getenv("CATTLE_ADDRESS"),
-			"internalAddress": os.Getenv("CATTLE_INTERNAL_ADDRESS"),
-			"roles":           split(os.Getenv("CATTLE_ROLE")),
+	node := &params.Node{
+		CustomConfig: params.CustomConfig{
+			Address:         os.Getenv("CATTLE_ADDRESS"),
+			InternalAddress: os.Getenv("CATTLE_INTERNAL_ADDRESS"),
+			Roles:           roles,
 		},
-		"etcd":              slice.ContainsString(roles, "etcd"),
-		"controlPlane":      slice.ContainsString(roles, "controlplane"),
-		"worker":            slice.ContainsString(roles, "worker"),
-		"requestedHostname": os.Getenv("CATTLE_NODE_NAME"),
-	}
-
-	for k, v := range params {
-		if m, ok := v.(map[string]string); ok {
-			for k, v := range m {
-				logrus.Infof("Option %s=%s", k, v)
-			}
-		} else {
-			logrus.Infof("Option %s=%v", k, v)
+		Etcd:              slice.ContainsString(roles, "etcd"),
+		ControlPlane:      slice.ContainsString(roles, "controlplane"),
+		Worker:            slice.ContainsString(roles, "worker"),
+		RequestedHostname: os.Getenv("CATTLE_NODE_NAME"),
+	}
+
+	logrus.Infof("Option address=%s", node.CustomConfig.Address)
+	logrus.Infof("Option internalAddress=%s", node.CustomConfig.InternalAddress)
+	logrus.Infof("Option roles=%v", node.CustomConfig.Roles)
+	logrus.Infof("Option etcd=%v", node.Etcd)
+	logrus.Infof("Option controlPlane=%v", node.ControlPlane)
+	logrus.Infof("Option worker=%v", node.Worker)
+	logrus.Infof("Option requestedHostname=%s", node.RequestedHostname)
+
+	node.Runtimes = runtimes.Discover(runtimes.DefaultTimeout)
+	for _, runtime := range node.Runtimes {
+		if runtime.Error != "" {
+			logrus.Warnf("Found %s at %s, not answering: %s", runtime.Name, runtime.Socket, runtime.Error)
+			continue
+		}
+		version := ""
+		if runtime.Version != "" {
+			version = " " + runtime.Version
+		}
+		if runtime.APIVersion != "" {
+			version += " (API " + runtime.APIVersion + ")"
+		}
+		logrus.Infof("Found %s%s at %s", runtime.Name, version, runtime.Socket)
+	}
+	if diagnosis := runtimes.Diagnose(node.Runtimes); diagnosis != "" {
+		logrus.Warn(diagnosis)
+		preflight.Record("runtimes", preflight.Warn, diagnosis)
+	} else {
+		preflight.Record("runtimes", preflight.Pass, fmt.Sprintf("%d container runtimes found", len(node.Runtimes)))
+	}
+
+	opts, err := factsOptions()
+	if err != nil {
+		return nil, err
+	}
+	extra, skipped := facts.Collect(opts)
+	if len(skipped) > 0 {
+		var problems []string
+		for _, err := range skipped {
+			problems = append(problems, err.Error())
 		}
+		preflight.Record("facts", preflight.Warn, fmt.Sprintf("%d fact namespaces collected, skipped %s", len(extra), strings.Join(problems, "; ")))
+	} else {
+		preflight.Record("facts", preflight.Pass, fmt.Sprintf("%d fact namespaces collected", len(extra)))
 	}
+	node.Extra = extra
 
-	return map[string]interface{}{
-		"node": params,
+	return &params.Payload{
+		Version: params.Version,
+		Node:    node,
+	}, nil
+}
+
+func factsOptions() (facts.Options, error) {
+	opts := facts.Options{
+		Dir: os.Getenv("CATTLE_FACTS_DIR"),
 	}
+
+	if timeout := os.Getenv("CATTLE_FACTS_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CATTLE_FACTS_TIMEOUT %q: %v", timeout, err)
+		}
+		opts.Timeout = d
+	}
+
+	if maxSize := os.Getenv("CATTLE_FACTS_MAX_SIZE"); maxSize != "" {
+		n, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid CATTLE_FACTS_MAX_SIZE %q: %v", maxSize, err)
+		}
+		opts.MaxSize = n
+	}
+
+	return opts, nil
 }
 
 func split(s string) []string {
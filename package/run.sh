@@ -9,7 +9,9 @@ error()
 AGENT_IMAGE=${AGENT_IMAGE:-ubuntu:14.04}
 
 export CATTLE_ADDRESS
+export CATTLE_CA_CHECKSUM
 export CATTLE_INTERNAL_ADDRESS
+export CATTLE_MODE
 export CATTLE_NODE_NAME
 export CATTLE_ROLE
 export CATTLE_SERVER
@@ -26,6 +28,7 @@ while true; do
         -w | --worker)             WORKER=true                ;;
         -p | --controlplane)       CONTROL=true               ;;
         -n | --node-name)          CATTLE_NODE_NAME=true      ;;
+        -m | --mode)        shift; CATTLE_MODE=$1             ;;
         --address)          shift; CATTLE_ADDRESS=$1          ;;
         --internal-address) shift; CATTLE_INTERNAL_ADDRESS=$1 ;;
         *) break;
@@ -37,14 +40,6 @@ if [ "$DEBUG" = true ]; then
     set -x
 fi
 
-if [ "$CATTLE_CLUSTER" != "true" ]; then
-    if [ ! -w /var/run/docker.sock ] || [ ! -S /var/run/docker.sock ]; then
-        error Please bind mount in the docker socket to /var/run/docker.sock
-        error example:  docker run -v /var/run/docker.sock:/var/run/docker.sock ...
-        exit 1
-    fi
-fi
-
 if [ -z "$CATTLE_NODE_NAME" ]; then
     CATTLE_NODE_NAME=$(hostname -s)
 fi
@@ -73,26 +68,12 @@ else
     fi
 fi
 
-if [ -n "$CATTLE_CA_CHECKSUM" ]; then
-    temp=$(mktemp)
-    curl --insecure -s -fL $CATTLE_SERVER/v3/settings/cacerts | jq -r .value > $temp
-    cat $temp
-    if [ "$(sha256sum $temp | awk '{print $1}')" != $CATTLE_CA_CHECKSUM ]; then
-        rm -f $temp
-        error $CATTLE_SERVER/v3/settings/cacerts does not match $CATTLE_CA_CHECKSUM
-        exit 1
-    fi
-    mkdir -p certs
-    mv $temp certs/serverca
-    export SSL_CERT_DIR=$(pwd)/certs
-fi
-
 if [ -z "$CATTLE_SERVER" ]; then
     error -- --server is a required option
     exit 1
 fi
 
-if [ "$CATTLE_CLUSTER" != "true" ]; then
+if [ "$CATTLE_CLUSTER" != "true" ] && [ "$CATTLE_MODE" != "cluster" ] && [ ! -d /cattle-credentials ]; then
     if [ -z "$CATTLE_TOKEN" ]; then
         error -- --token is a required option
         exit 1
@@ -104,4 +85,4 @@ if [ "$CATTLE_CLUSTER" != "true" ]; then
     fi
 fi
 
-exec agent
+exec agent "$@"
@@ -0,0 +1,78 @@
+package params
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rancher/agent/runtimes"
+)
+
+// Version is the schema version of the registration payload. Bump it whenever
+// a field changes meaning or is removed.
+const Version = 1
+
+// Payload is sent base64 encoded in the X-API-Tunnel-Params header.
+type Payload struct {
+	Version int      `json:"version"`
+	Node    *Node    `json:"node,omitempty"`
+	Cluster *Cluster `json:"cluster,omitempty"`
+}
+
+type Node struct {
+	CustomConfig      CustomConfig `json:"customConfig"`
+	Etcd              bool         `json:"etcd"`
+	ControlPlane      bool         `json:"controlPlane"`
+	Worker            bool         `json:"worker"`
+	RequestedHostname string       `json:"requestedHostname"`
+	// Runtimes are the container runtimes found on the node.
+	Runtimes []runtimes.Runtime `json:"runtimes,omitempty"`
+	// Extra holds site specific facts keyed by the namespace of their source.
+	Extra map[string]map[string]interface{} `json:"extra,omitempty"`
+}
+
+type CustomConfig struct {
+	Address         string   `json:"address"`
+	InternalAddress string   `json:"internalAddress"`
+	Roles           []string `json:"roles"`
+}
+
+type Cluster struct {
+	Address string `json:"address"`
+	Token   string `json:"token"`
+	CACert  string `json:"caCert"`
+	// Proxy means Address is served by the agent through the tunnel over
+	// plain HTTP, with the agent's credentials, and Token and CACert are empty.
+	Proxy bool `json:"proxy,omitempty"`
+}
+
+// Provider builds the registration payload and credentials for one agent mode.
+type Provider interface {
+	Params() (*Payload, error)
+	TokenAndURL() (string, string, error)
+}
+
+var providers = map[string]Provider{}
+
+// Register makes a Provider available for the given mode. It is meant to be
+// called from init.
+func Register(mode string, provider Provider) {
+	if _, ok := providers[mode]; ok {
+		panic("params provider already registered for mode " + mode)
+	}
+	providers[mode] = provider
+}
+
+// Get returns the Provider registered for mode.
+func Get(mode string) (Provider, error) {
+	provider, ok := providers[mode]
+	if !ok {
+		var modes []string
+		for name := range providers {
+			modes = append(modes, name)
+		}
+		sort.Strings(modes)
+		return nil, fmt.Errorf("no params provider for mode %q, available: %s", mode, strings.Join(modes, ", "))
+	}
+	return provider, nil
+}
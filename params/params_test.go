@@ -0,0 +1,136 @@
+package params
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// The server reads the params with the keys the agent sent before they were
+// typed, those must not change.
+func TestNodeWireKeys(t *testing.T) {
+	payload := &Payload{
+		Version: Version,
+		Node: &Node{
+			CustomConfig: CustomConfig{
+				Address:         "10.0.0.1",
+				InternalAddress: "192.168.0.1",
+				Roles:           []string{"etcd", "worker"},
+			},
+			Etcd:              true,
+			Worker:            true,
+			RequestedHostname: "node1",
+		},
+	}
+
+	expected := map[string]interface{}{
+		"version": float64(Version),
+		"node": map[string]interface{}{
+			"customConfig": map[string]interface{}{
+				"address":         "10.0.0.1",
+				"internalAddress": "192.168.0.1",
+				"roles":           []interface{}{"etcd", "worker"},
+			},
+			"etcd":              true,
+			"controlPlane":      false,
+			"worker":            true,
+			"requestedHostname": "node1",
+		},
+	}
+
+	assertWire(t, payload, expected)
+}
+
+func TestClusterWireKeys(t *testing.T) {
+	payload := &Payload{
+		Version: Version,
+		Cluster: &Cluster{
+			Address: "10.43.0.1:443",
+			Token:   "token",
+			CACert:  "Y2E=",
+		},
+	}
+
+	expected := map[string]interface{}{
+		"version": float64(Version),
+		"cluster": map[string]interface{}{
+			"address": "10.43.0.1:443",
+			"token":   "token",
+			"caCert":  "Y2E=",
+		},
+	}
+
+	assertWire(t, payload, expected)
+}
+
+func TestOptionalFieldsOnTheWire(t *testing.T) {
+	payload := &Payload{
+		Version: Version,
+		Node: &Node{
+			Extra: map[string]map[string]interface{}{
+				"site": {"rack": "r1"},
+			},
+		},
+		Cluster: &Cluster{Address: "kubernetes.agent.cattle.invalid:80", Proxy: true},
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := struct {
+		Node    map[string]interface{} `json:"node"`
+		Cluster map[string]interface{} `json:"cluster"`
+	}{}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := wire.Node["runtimes"]; ok {
+		t.Errorf("empty runtimes are sent: %s", data)
+	}
+	if !reflect.DeepEqual(wire.Node["extra"], map[string]interface{}{"site": map[string]interface{}{"rack": "r1"}}) {
+		t.Errorf("unexpected extra: %s", data)
+	}
+	if wire.Cluster["proxy"] != true {
+		t.Errorf("proxy is not sent: %s", data)
+	}
+}
+
+// assertWire checks payload encodes to expected and decodes back unchanged.
+func assertWire(t *testing.T, payload *Payload, expected map[string]interface{}) {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wire := map[string]interface{}{}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(wire, expected) {
+		t.Errorf("payload encodes to %s, expected %v", data, expected)
+	}
+
+	decoded := &Payload{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, payload) {
+		t.Errorf("payload decodes to %+v, expected %+v", decoded, payload)
+	}
+}
+
+func TestGet(t *testing.T) {
+	Register("test", nil)
+	defer delete(providers, "test")
+
+	if _, err := Get("test"); err != nil {
+		t.Errorf("registered provider not found: %v", err)
+	}
+	if _, err := Get("missing"); err == nil {
+		t.Error("expected an error for a mode without a provider")
+	}
+}
@@ -0,0 +1,52 @@
+package preflight
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	Pass = "PASS"
+	Warn = "WARN"
+	Fail = "FAIL"
+)
+
+// Result is the outcome of a check the agent made before connecting.
+type Result struct {
+	Check  string    `json:"check"`
+	Status string    `json:"status"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+var (
+	lock    sync.Mutex
+	results []Result
+)
+
+// Record keeps the latest result of check, replacing an earlier one.
+func Record(check, status, detail string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	result := Result{
+		Check:  check,
+		Status: status,
+		Detail: detail,
+		Time:   time.Now(),
+	}
+	for i := range results {
+		if results[i].Check == check {
+			results[i] = result
+			return
+		}
+	}
+	results = append(results, result)
+}
+
+// Results returns the recorded results in the order the checks first ran.
+func Results() []Result {
+	lock.Lock()
+	defer lock.Unlock()
+	return append([]Result(nil), results...)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+
+	"github.com/rancher/agent/params"
+	"github.com/rancher/agent/redact"
+)
+
+type printedParams struct {
+	Mode    string              `json:"mode"`
+	Reasons []string            `json:"reasons"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Params  *params.Payload     `json:"params"`
+}
+
+func printParamsCommand(args []string) error {
+	fs, opts := newFlagSet("print-params")
+	showSecrets := fs.Bool("show-secrets", false, "print the token and credentials instead of redacting them")
+	if err := parse(fs, opts, args); err != nil {
+		return err
+	}
+
+	reg, err := resolve(opts)
+	if err != nil {
+		return err
+	}
+
+	output := printedParams{
+		Mode:    reg.decision.Mode,
+		Reasons: reg.decision.Reasons,
+		URL:     reg.wsURL,
+		Headers: reg.headers,
+		Params:  reg.payload,
+	}
+
+	if !*showSecrets {
+		output.Params, output.Headers, err = redactRegistration(reg)
+		if err != nil {
+			return err
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+// redactRegistration masks the token and any credentials in the payload. The
+// params header is re-encoded from the redacted payload so it still decodes.
+func redactRegistration(reg *registration) (*params.Payload, map[string][]string, error) {
+	payload := *reg.payload
+	if payload.Cluster != nil {
+		cluster := *payload.Cluster
+		cluster.Token = redact.Mask
+		payload.Cluster = &cluster
+	}
+
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := map[string][]string{}
+	for k, v := range reg.headers {
+		headers[k] = v
+	}
+	headers[Token] = []string{redact.Mask}
+	headers[Params] = []string{base64.StdEncoding.EncodeToString(bytes)}
+
+	return &payload, headers, nil
+}
@@ -0,0 +1,76 @@
+package redact
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every secret.
+const Mask = "[REDACTED]"
+
+// minSecretLength keeps short values such as "true" from being masked everywhere.
+const minSecretLength = 8
+
+type pattern struct {
+	re *regexp.Regexp
+	// replacement keeps the prefix captured by the first group, if any
+	replacement string
+}
+
+var patterns = []pattern{
+	// PEM private keys, including CA keys
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), Mask},
+	// Authorization: Bearer and Basic credentials
+	{regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)[A-Za-z0-9\-._~+/]+=*`), "${1}" + Mask},
+	// Headers carrying credentials
+	{regexp.MustCompile(`(?i)(\b(?:x-registry-auth|x-registry-config|x-api-tunnel-token)"?\s*[:=]\s*"?\[?"?)[^\s",\]]+`), "${1}" + Mask},
+	// JSON fields carrying credentials, such as docker auth configs and kubeconfigs
+	{regexp.MustCompile(`(?i)("(?:token|bearertoken|password|secret|auth|identitytoken|registrytoken|client-key-data)"\s*:\s*")[^"]*`), "${1}" + Mask},
+	// Environment style assignments
+	{regexp.MustCompile(`\b([A-Z_]*(?:TOKEN|PASSWORD|SECRET)[A-Z_]*=)[^\s"]+`), "${1}" + Mask},
+	// Rancher API tokens
+	{regexp.MustCompile(`\btoken-[a-z0-9]{5}:[a-z0-9]{20,}`), Mask},
+	// JSON web tokens, such as service account tokens
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`), Mask},
+}
+
+var (
+	secretsLock sync.RWMutex
+	secrets     []string
+)
+
+// AddSecret masks every occurrence of value from now on. Values shorter than
+// eight characters are ignored.
+func AddSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		return
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	for _, secret := range secrets {
+		if secret == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+}
+
+// String masks the registered secrets and known credential patterns in s.
+func String(s string) string {
+	secretsLock.RLock()
+	for _, secret := range secrets {
+		if strings.Contains(s, secret) {
+			s = strings.Replace(s, secret, Mask, -1)
+		}
+	}
+	secretsLock.RUnlock()
+
+	for _, p := range patterns {
+		s = p.re.ReplaceAllString(s, p.replacement)
+	}
+	return s
+}
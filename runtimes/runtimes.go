@@ -0,0 +1,255 @@
+package runtimes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	Docker     = "docker"
+	Containerd = "containerd"
+	CRIO       = "cri-o"
+	Podman     = "podman"
+
+	// DockerSocket is where the server expects the Docker API.
+	DockerSocket = "/var/run/docker.sock"
+
+	DefaultTimeout = 5 * time.Second
+
+	maxBodySize = 64 * 1024
+)
+
+type candidate struct {
+	name string
+	// glob matches the socket, several matches are several runtimes
+	glob  string
+	probe func(ctx context.Context, socket string) (*Runtime, error)
+}
+
+var candidates = []candidate{
+	{name: Docker, glob: DockerSocket, probe: probeDocker},
+	{name: Docker, glob: "/run/docker.sock", probe: probeDocker},
+	{name: Docker, glob: "/run/user/*/docker.sock", probe: probeDocker},
+	{name: Podman, glob: "/run/podman/podman.sock", probe: probeDocker},
+	{name: Podman, glob: "/run/user/*/podman/podman.sock", probe: probeDocker},
+	{name: Containerd, glob: "/run/containerd/containerd.sock", probe: probeDial},
+	{name: CRIO, glob: "/var/run/crio/crio.sock", probe: probeCRIO},
+}
+
+// Runtime is a container runtime socket found on the host.
+type Runtime struct {
+	Name   string `json:"name"`
+	Socket string `json:"socket"`
+	// Version and APIVersion are only known for runtimes with an HTTP API.
+	Version    string `json:"version,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Error is why the runtime didn't answer, if it didn't.
+	Error string `json:"error,omitempty"`
+}
+
+// DockerAPI returns whether the runtime serves the Docker Engine API.
+func (r Runtime) DockerAPI() bool {
+	return r.Name == Docker || r.Name == Podman
+}
+
+// Find returns the known runtime sockets that exist on the host without
+// contacting them.
+func Find() []Runtime {
+	var result []Runtime
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		matches, _ := filepath.Glob(c.glob)
+		sort.Strings(matches)
+		for _, socket := range matches {
+			real, err := filepath.EvalSymlinks(socket)
+			if err != nil || seen[real] || !isSocket(real) {
+				continue
+			}
+			seen[real] = true
+			result = append(result, Runtime{Name: c.name, Socket: socket})
+		}
+	}
+	return result
+}
+
+// Found returns the runtime serving socket if it is one of the known runtime
+// sockets and exists on the host now, without contacting it.
+func Found(socket string) (Runtime, bool) {
+	if filepath.Clean(socket) != socket {
+		return Runtime{}, false
+	}
+	for _, c := range candidates {
+		if matched, _ := filepath.Match(c.glob, socket); matched && isSocket(socket) {
+			return Runtime{Name: c.name, Socket: socket}, true
+		}
+	}
+	return Runtime{}, false
+}
+
+// Discover finds the runtime sockets on the host and asks each for its
+// version, waiting at most timeout per runtime.
+func Discover(timeout time.Duration) []Runtime {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	result := Find()
+	for i, runtime := range result {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		found, err := probeFor(runtime)(ctx, runtime.Socket)
+		cancel()
+		if err != nil {
+			result[i].Error = err.Error()
+			continue
+		}
+		found.Socket = runtime.Socket
+		if found.Name == "" {
+			found.Name = runtime.Name
+		}
+		result[i] = *found
+	}
+	return result
+}
+
+func probeFor(runtime Runtime) func(context.Context, string) (*Runtime, error) {
+	for _, c := range candidates {
+		if c.name == runtime.Name {
+			return c.probe
+		}
+	}
+	return probeDial
+}
+
+// Diagnose explains what the server can't do with the runtimes found, or
+// returns an empty string if a Docker API is available where it expects it.
+func Diagnose(runtimes []Runtime) string {
+	var found, dockerAPIs []string
+	for _, r := range runtimes {
+		found = append(found, fmt.Sprintf("%s at %s", r.Name, r.Socket))
+		if r.DockerAPI() {
+			if r.Socket == DockerSocket && r.Error == "" {
+				return ""
+			}
+			dockerAPIs = append(dockerAPIs, r.Socket)
+		}
+	}
+
+	if len(runtimes) == 0 {
+		return fmt.Sprintf("no container runtime socket found; Rancher manages nodes through the Docker API at %s, "+
+			"bind mount it into the agent container or install docker", DockerSocket)
+	}
+	for _, r := range runtimes {
+		if r.Socket == DockerSocket && r.Error != "" {
+			return fmt.Sprintf("docker at %s is not answering: %s", DockerSocket, r.Error)
+		}
+	}
+	if len(dockerAPIs) > 0 {
+		return fmt.Sprintf("found %s but no Docker API at %s; add --rewrites unix:%s=%s to let the server use it",
+			strings.Join(found, ", "), DockerSocket, DockerSocket, dockerAPIs[0])
+	}
+	return fmt.Sprintf("found %s but no Docker API; Rancher manages nodes through the Docker API at %s",
+		strings.Join(found, ", "), DockerSocket)
+}
+
+// HTTPClient returns a client for the HTTP API served on socket, requests
+// must use http://localhost as the host.
+func HTTPClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func get(ctx context.Context, socket, path string, into interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := HTTPClient(socket).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if into == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, into); err != nil {
+		return fmt.Errorf("failed to parse GET %s: %v", path, err)
+	}
+	return nil
+}
+
+// probeDocker asks a Docker API, which podman serves too, for its version.
+func probeDocker(ctx context.Context, socket string) (*Runtime, error) {
+	version := struct {
+		Version    string
+		APIVersion string `json:"ApiVersion"`
+		Components []struct {
+			Name string
+		}
+	}{}
+	if err := get(ctx, socket, "/version", &version); err != nil {
+		return nil, err
+	}
+
+	runtime := &Runtime{
+		Version:    version.Version,
+		APIVersion: version.APIVersion,
+	}
+	// podman-docker links podman to the docker socket
+	for _, component := range version.Components {
+		if strings.HasPrefix(component.Name, "Podman") {
+			runtime.Name = Podman
+		}
+	}
+	return runtime, nil
+}
+
+// probeCRIO checks the HTTP API CRI-O serves next to CRI, it has no version.
+func probeCRIO(ctx context.Context, socket string) (*Runtime, error) {
+	if err := get(ctx, socket, "/info", nil); err != nil {
+		return nil, err
+	}
+	return &Runtime{}, nil
+}
+
+// probeDial checks the socket accepts connections, for runtimes that only
+// serve gRPC.
+func probeDial(ctx context.Context, socket string) (*Runtime, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return &Runtime{}, nil
+}
+
+func isSocket(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
@@ -0,0 +1,50 @@
+package runtimes
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFound(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	defer func(old []candidate) { candidates = old }(candidates)
+	candidates = []candidate{
+		{name: Docker, glob: filepath.Join(dir, "docker.sock")},
+		{name: Docker, glob: filepath.Join(dir, "user", "*", "docker.sock")},
+		{name: Containerd, glob: filepath.Join(dir, "containerd.sock")},
+	}
+
+	docker := filepath.Join(dir, "docker.sock")
+	if _, ok := Found(docker); ok {
+		t.Fatal("found a runtime before its socket exists")
+	}
+
+	// A runtime starting after the agent is found once it listens.
+	for _, socket := range []string{docker, filepath.Join(dir, "user", "1000", "docker.sock"), filepath.Join(dir, "containerd.sock"), filepath.Join(dir, "other.sock")} {
+		if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+	}
+
+	for socket, expected := range map[string]string{
+		docker: Docker,
+		filepath.Join(dir, "user", "1000", "docker.sock"): Docker,
+		filepath.Join(dir, "containerd.sock"):             Containerd,
+		filepath.Join(dir, "other.sock"):                  "",
+		dir + "/user/1000/../1000/docker.sock":            "",
+		filepath.Join(dir, "user", "1001", "docker.sock"): "",
+	} {
+		runtime, ok := Found(socket)
+		if ok != (expected != "") || runtime.Name != expected {
+			t.Errorf("%s: found %+v (%v), expected %q", socket, runtime, ok, expected)
+		}
+	}
+}
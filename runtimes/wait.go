@@ -0,0 +1,108 @@
+package runtimes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultWaitTimeout    = 5 * time.Minute
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+)
+
+// WaitOptions configure Wait.
+type WaitOptions struct {
+	// Socket serves the Docker API, DockerSocket if empty.
+	Socket string
+	// Timeout bounds the whole wait, zero waits forever.
+	Timeout time.Duration
+	// ProbeTimeout bounds each attempt.
+	ProbeTimeout time.Duration
+	// InitialBackoff is the delay after the first failed attempt, it doubles
+	// up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (o *WaitOptions) defaults() {
+	if o.Socket == "" {
+		o.Socket = DockerSocket
+	}
+	if o.ProbeTimeout <= 0 {
+		o.ProbeTimeout = DefaultTimeout
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = DefaultInitialBackoff
+	}
+	if o.MaxBackoff < o.InitialBackoff {
+		o.MaxBackoff = DefaultMaxBackoff
+	}
+}
+
+// Wait blocks until the Docker API on the socket answers /_ping and /version,
+// retrying with backoff. It returns the runtime, or the last error once
+// the timeout passed.
+func Wait(opts WaitOptions) (*Runtime, error) {
+	opts.defaults()
+
+	start := time.Now()
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		runtime, err := ping(opts.Socket, opts.ProbeTimeout)
+		if err == nil {
+			if attempt > 1 {
+				logrus.Infof("Container runtime at %s answered after %s", opts.Socket, time.Since(start).Round(time.Second))
+			}
+			return runtime, nil
+		}
+
+		elapsed := time.Since(start)
+		delay := backoff
+		if opts.Timeout > 0 {
+			remaining := opts.Timeout - elapsed
+			if remaining <= 0 {
+				return nil, fmt.Errorf("container runtime at %s did not answer within %s: %v", opts.Socket, opts.Timeout, err)
+			}
+			// Make the last attempt at the deadline.
+			if delay > remaining {
+				delay = remaining
+			}
+		}
+
+		logrus.Infof("Waiting for the container runtime at %s (attempt %d, %s elapsed, retrying in %s): %v",
+			opts.Socket, attempt, elapsed.Round(time.Second), delay.Round(time.Millisecond), err)
+		time.Sleep(delay)
+
+		backoff *= 2
+		if backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
+
+func ping(socket string, timeout time.Duration) (*Runtime, error) {
+	if !isSocket(socket) {
+		return nil, fmt.Errorf("%s is not a socket", socket)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := get(ctx, socket, "/_ping", nil); err != nil {
+		return nil, err
+	}
+
+	runtime, err := probeDocker(ctx, socket)
+	if err != nil {
+		return nil, err
+	}
+	runtime.Socket = socket
+	if runtime.Name == "" {
+		runtime.Name = Docker
+	}
+	return runtime, nil
+}
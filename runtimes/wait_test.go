@@ -0,0 +1,198 @@
+package runtimes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves /_ping and /version like the Docker API, failing the
+// first pings as a starting daemon does.
+type fakeDocker struct {
+	*httptest.Server
+	socket     string
+	failPings  int32
+	pings      int32
+	components []string
+}
+
+func newFakeDocker(dir string) *fakeDocker {
+	d := &fakeDocker{socket: filepath.Join(dir, "docker.sock")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&d.pings, 1) <= atomic.LoadInt32(&d.failPings) {
+			http.Error(rw, "daemon is starting", http.StatusInternalServerError)
+			return
+		}
+		rw.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/version", func(rw http.ResponseWriter, req *http.Request) {
+		version := map[string]interface{}{
+			"Version":    "18.09.2",
+			"ApiVersion": "1.39",
+		}
+		var components []map[string]string
+		for _, name := range d.components {
+			components = append(components, map[string]string{"Name": name})
+		}
+		if components != nil {
+			version["Components"] = components
+		}
+		json.NewEncoder(rw).Encode(version)
+	})
+	d.Server = httptest.NewUnstartedServer(mux)
+	return d
+}
+
+// listen starts serving on the socket.
+func (d *fakeDocker) listen() error {
+	l, err := net.Listen("unix", d.socket)
+	if err != nil {
+		return err
+	}
+	d.Listener.Close()
+	d.Listener = l
+	d.Start()
+	return nil
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "runtimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func waitOptions(socket string, timeout time.Duration) WaitOptions {
+	return WaitOptions{
+		Socket:         socket,
+		Timeout:        timeout,
+		ProbeTimeout:   time.Second,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+	}
+}
+
+func TestWaitAnswers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	docker := newFakeDocker(dir)
+	if err := docker.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+
+	runtime, err := Wait(waitOptions(docker.socket, 5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Runtime{Name: Docker, Socket: docker.socket, Version: "18.09.2", APIVersion: "1.39"}
+	if *runtime != expected {
+		t.Errorf("got %+v, expected %+v", *runtime, expected)
+	}
+}
+
+func TestWaitPodman(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	docker := newFakeDocker(dir)
+	docker.components = []string{"Podman Engine"}
+	if err := docker.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+
+	runtime, err := Wait(waitOptions(docker.socket, 5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.Name != Podman {
+		t.Errorf("runtime is %s, expected %s", runtime.Name, Podman)
+	}
+}
+
+func TestWaitRetriesFailingPing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	docker := newFakeDocker(dir)
+	docker.failPings = 3
+	if err := docker.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+
+	if _, err := Wait(waitOptions(docker.socket, 5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if pings := atomic.LoadInt32(&docker.pings); pings != 4 {
+		t.Errorf("pinged %d times, expected 4", pings)
+	}
+}
+
+func TestWaitForSocket(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	docker := newFakeDocker(dir)
+	defer docker.Close()
+
+	time.AfterFunc(200*time.Millisecond, func() {
+		if err := docker.listen(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	runtime, err := Wait(waitOptions(docker.socket, 5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.Version != "18.09.2" {
+		t.Errorf("got version %q", runtime.Version)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	notSocket := filepath.Join(dir, "docker.sock")
+	if err := ioutil.WriteFile(notSocket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := Wait(waitOptions(notSocket, 300*time.Millisecond))
+	if err == nil {
+		t.Fatal("waiting for a file that isn't a socket succeeded")
+	}
+	if !strings.Contains(err.Error(), "did not answer within 300ms") || !strings.Contains(err.Error(), "is not a socket") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waited %s for a 300ms timeout", elapsed)
+	}
+}
+
+func TestWaitTimeoutFailingPing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	docker := newFakeDocker(dir)
+	docker.failPings = 1000
+	if err := docker.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer docker.Close()
+
+	_, err := Wait(waitOptions(docker.socket, 300*time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "daemon is starting") {
+		t.Errorf("expected the last ping error, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	socketEnv       = "NOTIFY_SOCKET"
+	watchdogUsecEnv = "WATCHDOG_USEC"
+	watchdogPIDEnv  = "WATCHDOG_PID"
+)
+
+// Notifier sends state updates to systemd. It does nothing when the agent
+// isn't started by systemd with Type=notify.
+type Notifier struct {
+	socket string
+}
+
+// New returns a Notifier for the socket in $NOTIFY_SOCKET.
+func New() *Notifier {
+	return NewForSocket(os.Getenv(socketEnv))
+}
+
+// NewForSocket returns a Notifier for socket, where a leading @ denotes an
+// abstract socket.
+func NewForSocket(socket string) *Notifier {
+	if len(socket) > 0 && socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	return &Notifier{socket: socket}
+}
+
+// Enabled returns whether there is a socket to notify.
+func (n *Notifier) Enabled() bool {
+	return n.socket != ""
+}
+
+// Notify sends state, e.g. READY=1, to systemd.
+func (n *Notifier) Notify(state string) error {
+	if !n.Enabled() {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+func (n *Notifier) Ready() error {
+	return n.Notify("READY=1")
+}
+
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+func (n *Notifier) Watchdog() error {
+	return n.Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the interval systemd expects watchdog pings in, or
+// zero if the watchdog isn't enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv(watchdogUsecEnv)
+	if usec == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv(watchdogPIDEnv); pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %v", watchdogPIDEnv, pid, err)
+		}
+		if p != os.Getpid() {
+			return 0, nil
+		}
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", watchdogUsecEnv, usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
@@ -0,0 +1,152 @@
+package sdnotify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, name string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify")
+	conn := listen(t, socket)
+	defer conn.Close()
+
+	defer setenv(socketEnv, socket)()
+	n := New()
+	if !n.Enabled() {
+		t.Fatalf("notifier for %s is not enabled", socket)
+	}
+
+	for _, test := range []struct {
+		send     func() error
+		expected string
+	}{
+		{n.Ready, "READY=1"},
+		{func() error { return n.Status("Connected to rancher") }, "STATUS=Connected to rancher"},
+		{n.Watchdog, "WATCHDOG=1"},
+		{func() error { return n.Notify("STOPPING=1") }, "STOPPING=1"},
+	} {
+		if err := test.send(); err != nil {
+			t.Fatal(err)
+		}
+		if got := receive(t, conn); got != test.expected {
+			t.Errorf("received %q, expected %q", got, test.expected)
+		}
+	}
+}
+
+func TestNotifyAbstractSocket(t *testing.T) {
+	name := fmt.Sprintf("rancher-agent-sdnotify-test-%d", os.Getpid())
+	conn := listen(t, "@"+name)
+	defer conn.Close()
+
+	if err := NewForSocket("@" + name).Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, conn); got != "READY=1" {
+		t.Errorf("received %q, expected READY=1", got)
+	}
+}
+
+func TestNotifyDisabled(t *testing.T) {
+	defer setenv(socketEnv, "")()
+	n := New()
+	if n.Enabled() {
+		t.Error("notifier is enabled without NOTIFY_SOCKET")
+	}
+	if err := n.Ready(); err != nil {
+		t.Errorf("disabled notifier returned %v", err)
+	}
+}
+
+func TestNotifyMissingSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := NewForSocket(filepath.Join(dir, "missing")).Ready(); err == nil {
+		t.Error("notifying a missing socket succeeded")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := fmt.Sprint(os.Getpid())
+	for _, test := range []struct {
+		usec, pid string
+		expected  time.Duration
+		invalid   bool
+	}{
+		{usec: "", expected: 0},
+		{usec: "30000000", expected: 30 * time.Second},
+		{usec: "30000000", pid: pid, expected: 30 * time.Second},
+		{usec: "30000000", pid: fmt.Sprint(os.Getpid() + 1), expected: 0},
+		{usec: "30000000", pid: "self", invalid: true},
+		{usec: "0", invalid: true},
+		{usec: "-1", invalid: true},
+		{usec: "30s", invalid: true},
+	} {
+		restoreUsec := setenv(watchdogUsecEnv, test.usec)
+		restorePID := setenv(watchdogPIDEnv, test.pid)
+		interval, err := WatchdogInterval()
+		restorePID()
+		restoreUsec()
+
+		if test.invalid {
+			if err == nil {
+				t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: expected an error, got %v", test.usec, test.pid, interval)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: %v", test.usec, test.pid, err)
+		} else if interval != test.expected {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %v, expected %v", test.usec, test.pid, interval, test.expected)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	caCertsPath    = "/v3/settings/cacerts"
+	caCertsTimeout = 30 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions configure how the agent verifies the server.
+type TLSOptions struct {
+	// CABundle is a PEM file or a directory of PEM files trusted in addition
+	// to the system roots.
+	CABundle string
+	// CAChecksum pins the sha256 of the CA certificates published by the server,
+	// which are then trusted in addition to the system roots.
+	CAChecksum string
+	// ServerName overrides the name the server certificate is verified against.
+	ServerName string
+	// MinVersion is the minimum TLS version: 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string
+	// InsecureSkipVerify disables certificate verification entirely.
+	InsecureSkipVerify bool
+}
+
+// TLSConfig builds the TLS config used for every connection to the server.
+func TLSConfig(server *url.URL, opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	minVersion := opts.MinVersion
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid minimum TLS version %q, must be 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	config.MinVersion = version
+
+	if opts.InsecureSkipVerify {
+		logrus.Warn("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+		logrus.Warnf("TLS certificate verification is DISABLED for %s", server.Host)
+		logrus.Warn("The connection can be intercepted, only use --insecure-skip-verify in labs")
+		logrus.Warn("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+		return config, nil
+	}
+
+	if opts.CABundle == "" && opts.CAChecksum == "" {
+		return config, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		logrus.Warnf("Failed to load system CA certificates: %v", err)
+		pool = x509.NewCertPool()
+	}
+
+	if opts.CABundle != "" {
+		if err := addCABundle(pool, opts.CABundle); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.CAChecksum != "" {
+		cacerts, err := FetchCACerts(server, config, caCertsTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if actual := CAChecksum(cacerts); actual != opts.CAChecksum {
+			return nil, fmt.Errorf("%s does not match CA checksum %s, got %s",
+				URL(server, caCertsPath), opts.CAChecksum, actual)
+		}
+		if !pool.AppendCertsFromPEM([]byte(cacerts)) {
+			return nil, fmt.Errorf("no certificates found in %s", URL(server, caCertsPath))
+		}
+		logrus.Infof("Trusting CA certificates from %s matching checksum %s", URL(server, caCertsPath), opts.CAChecksum)
+	}
+
+	config.RootCAs = pool
+	return config, nil
+}
+
+// FetchCACerts downloads the CA certificates published by the server. The
+// server can't be verified yet, so the download skips verification and the
+// result must be checked against a checksum.
+func FetchCACerts(server *url.URL, config *tls.Config, timeout time.Duration) (string, error) {
+	insecure := &tls.Config{}
+	if config != nil {
+		insecure = config.Clone()
+	}
+	insecure.InsecureSkipVerify = true
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: insecure,
+		},
+	}
+
+	resp, err := client.Get(URL(server, caCertsPath))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s returned %s: %s", caCertsPath, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	setting := struct {
+		Value string `json:"value"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&setting); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", caCertsPath, err)
+	}
+	return setting.Value, nil
+}
+
+// CAChecksum is the checksum of the CA certificates as shown in the Rancher UI,
+// the sha256 of the value followed by a newline.
+func CAChecksum(cacerts string) string {
+	sum := sha256.Sum256([]byte(cacerts + "\n"))
+	return hex.EncodeToString(sum[:])
+}
+
+func addCABundle(pool *x509.CertPool, bundle string) error {
+	info, err := os.Stat(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+
+	files := []string{bundle}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(bundle)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		files = nil
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(bundle, entry.Name()))
+			}
+		}
+	}
+
+	found := false
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		if pool.AppendCertsFromPEM(bytes) {
+			logrus.Infof("Trusting CA certificates from %s", file)
+			found = true
+		} else if !info.IsDir() {
+			return fmt.Errorf("no PEM certificates found in CA bundle %s", file)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no PEM certificates found in CA bundle %s", bundle)
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	pem    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	server *httptest.Server
+	url    *url.URL
+}
+
+// newTestCA starts a server with a certificate for rancher.test and
+// 127.0.0.1 issued by a freshly generated CA, publishing the CA like Rancher.
+func newTestCA(t *testing.T, maxVersion uint16) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{
+		pem:  strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))),
+		cert: cert,
+		key:  key,
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "rancher.test"},
+		DNSNames:     []string{"rancher.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, cert, &leafKey.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca.server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == caCertsPath {
+			json.NewEncoder(rw).Encode(map[string]string{"value": ca.pem})
+		}
+	}))
+	ca.server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}},
+		MaxVersion:   maxVersion,
+	}
+	ca.server.StartTLS()
+
+	ca.url, err = ParseURL(ca.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// connect makes a request to the test server with config.
+func (ca *testCA) connect(config *tls.Config) error {
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+	resp, err := client.Get(ca.server.URL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCABundleFile(t *testing.T) {
+	ca := newTestCA(t, 0)
+	defer ca.server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(bundle, []byte(ca.pem), 0644)
+
+	config, err := TLSConfig(ca.url, TLSOptions{CABundle: bundle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err != nil {
+		t.Errorf("connection with the CA bundle failed: %v", err)
+	}
+
+	config, err = TLSConfig(ca.url, TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err == nil {
+		t.Error("connection without the CA bundle succeeded")
+	}
+}
+
+func TestCABundleDirectory(t *testing.T) {
+	ca := newTestCA(t, 0)
+	defer ca.server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden.pem"), []byte("garbage"), 0644)
+	if _, err := TLSConfig(ca.url, TLSOptions{CABundle: dir}); err == nil {
+		t.Error("expected an error for a directory without certificates")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), []byte(ca.pem), 0644)
+	config, err := TLSConfig(ca.url, TLSOptions{CABundle: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err != nil {
+		t.Errorf("connection with the CA bundle directory failed: %v", err)
+	}
+}
+
+func TestCABundleInvalid(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	u, _ := ParseURL("https://rancher.test")
+	bundle := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(bundle, []byte("not a certificate"), 0644)
+	if _, err := TLSConfig(u, TLSOptions{CABundle: bundle}); err == nil {
+		t.Error("expected an error for a bundle without certificates")
+	}
+	if _, err := TLSConfig(u, TLSOptions{CABundle: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("expected an error for a missing bundle")
+	}
+}
+
+func TestCAChecksum(t *testing.T) {
+	ca := newTestCA(t, 0)
+	defer ca.server.Close()
+
+	config, err := TLSConfig(ca.url, TLSOptions{CAChecksum: CAChecksum(ca.pem)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err != nil {
+		t.Errorf("connection trusting the pinned CA failed: %v", err)
+	}
+
+	_, err = TLSConfig(ca.url, TLSOptions{CAChecksum: strings.Repeat("0", 64)})
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	ca := newTestCA(t, 0)
+	defer ca.server.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(bundle, []byte(ca.pem), 0644)
+
+	config, err := TLSConfig(ca.url, TLSOptions{CABundle: bundle, ServerName: "rancher.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err != nil {
+		t.Errorf("connection verifying rancher.test failed: %v", err)
+	}
+
+	config, err = TLSConfig(ca.url, TLSOptions{CABundle: bundle, ServerName: "other.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err == nil {
+		t.Error("connection verifying other.test succeeded")
+	}
+}
+
+func TestMinVersion(t *testing.T) {
+	u, _ := ParseURL("https://rancher.test")
+	for version, expected := range map[string]uint16{
+		"":    tls.VersionTLS12,
+		"1.0": tls.VersionTLS10,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	} {
+		config, err := TLSConfig(u, TLSOptions{MinVersion: version})
+		if err != nil {
+			t.Errorf("minimum version %q: %v", version, err)
+			continue
+		}
+		if config.MinVersion != expected {
+			t.Errorf("minimum version %q is %x, expected %x", version, config.MinVersion, expected)
+		}
+	}
+
+	if _, err := TLSConfig(u, TLSOptions{MinVersion: "1.4"}); err == nil {
+		t.Error("expected an error for minimum version 1.4")
+	}
+}
+
+func TestMinVersionRefusesOlderServer(t *testing.T) {
+	ca := newTestCA(t, tls.VersionTLS12)
+	defer ca.server.Close()
+
+	config, err := TLSConfig(ca.url, TLSOptions{MinVersion: "1.3", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err == nil {
+		t.Error("connection to a TLS 1.2 server with minimum version 1.3 succeeded")
+	}
+
+	config, err = TLSConfig(ca.url, TLSOptions{MinVersion: "1.2", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.connect(config); err != nil {
+		t.Errorf("connection to a TLS 1.2 server with minimum version 1.2 failed: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const connectPath = "/v3/connect"
+
+// ParseURL validates the configured server URL. It must be an absolute http or
+// https URL; anything after the host is kept as a path prefix.
+func ParseURL(server string) (*url.URL, error) {
+	server = strings.TrimSpace(server)
+	if server == "" {
+		return nil, fmt.Errorf("server URL is empty")
+	}
+
+	// Without a scheme host:port parses as an opaque URL with host as its
+	// scheme, or fails to parse for an IP address.
+	if !strings.Contains(server, "://") {
+		return nil, fmt.Errorf("invalid server URL %q: missing scheme, use https://%s", server, strings.TrimPrefix(server, "//"))
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL %q: %v", server, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid server URL %q: scheme must be http or https", server)
+	}
+
+	if u.Opaque != "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q: missing host", server)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("invalid server URL %q: credentials are not allowed in the URL", server)
+	}
+
+	return u, nil
+}
+
+// URL returns the server URL for path, keeping the path prefix and query of the
+// configured URL.
+func URL(server *url.URL, path string) string {
+	u := *server
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// ConnectURL returns the websocket URL of the tunnel endpoint: http maps to ws
+// and https to wss.
+func ConnectURL(server *url.URL) string {
+	u, _ := url.Parse(URL(server, connectPath))
+	if u.Scheme == "http" {
+		u.Scheme = "ws"
+	} else {
+		u.Scheme = "wss"
+	}
+	return u.String()
+}
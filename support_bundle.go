@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rancher/agent/admin"
+	"github.com/rancher/agent/bundle"
+	"github.com/rancher/agent/facts"
+	"github.com/rancher/agent/install"
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/runtimes"
+	"github.com/sirupsen/logrus"
+)
+
+func supportBundleCommand(args []string) error {
+	fs, socket := newAdminFlagSet("support-bundle")
+	output := fs.String("output", "", "file to write the bundle to, - for stdout, a name with the host and time if empty")
+	kubeLogs := fs.Bool("kube-logs", false, "add the logs of the Kubernetes component containers")
+	logLines := fs.Int("log-lines", bundle.DefaultLogLines, "number of journal and container log lines to add")
+	maxFileSize := fs.Int64("max-file-size", bundle.DefaultMaxFileSize, "maximum size of each file in the bundle, in bytes")
+	maxSize := fs.Int64("max-size", bundle.DefaultMaxSize, "maximum size of all files in the bundle before compression, in bytes")
+	timeout := fs.Duration("timeout", bundle.DefaultTimeout, "timeout for each command and container runtime request")
+	fs.Parse(args)
+
+	// The running agent redacts its own state, this covers the host files
+	// and command output.
+	if token := os.Getenv("CATTLE_TOKEN"); token != "" {
+		redact.AddSecret(token)
+	}
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%s-bundle-%s-%s", install.Name, hostname, time.Now().UTC().Format("20060102-150405"))
+	if *output == "" {
+		*output = name + ".tar.gz"
+	} else if *output != "-" {
+		name = strings.TrimSuffix(strings.TrimSuffix(filepath.Base(*output), ".gz"), ".tar")
+	}
+
+	opts := bundle.Options{
+		Name:           name,
+		Version:        VERSION,
+		Facts:          &facts.Options{Dir: os.Getenv("CATTLE_FACTS_DIR")},
+		Runtimes:       runtimes.Discover(runtimes.DefaultTimeout),
+		Files:          bundle.DefaultFiles,
+		Commands:       bundle.DefaultCommands(install.Name, *logLines),
+		KubeLogs:       *kubeLogs,
+		LogLines:       *logLines,
+		MaxFileSize:    *maxFileSize,
+		MaxSize:        *maxSize,
+		Timeout:        *timeout,
+		KubeContainers: bundle.KubeContainers,
+	}
+	info, err := admin.NewClient(*socket).Introspect(0)
+	if err != nil {
+		opts.AgentError = err.Error()
+	} else {
+		opts.Agent = info
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	manifest, err := bundle.Write(w, opts)
+	if err != nil {
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return err
+	}
+
+	for _, entry := range manifest.Failed() {
+		logrus.Warnf("Incomplete %s from %s: %s", entry.Name, entry.Source, entry.Error)
+	}
+	if *output != "-" {
+		fmt.Printf("Wrote %s with %d entries, %d incomplete\n", *output, len(manifest.Entries), len(manifest.Failed()))
+	}
+	return nil
+}
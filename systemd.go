@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/agent/sdnotify"
+	"github.com/rancher/agent/tunnel"
+	"github.com/sirupsen/logrus"
+)
+
+// notifySystemd reports readiness, status and liveness of the tunnel to systemd
+// when the agent runs as a Type=notify unit. Watchdog pings are only sent when
+// the server answers a tunnel ping, so systemd restarts an agent whose tunnel
+// is stuck.
+func notifySystemd(client *tunnel.Client) {
+	notifier := sdnotify.New()
+	if !notifier.Enabled() {
+		return
+	}
+
+	interval, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		logrus.Warnf("Ignoring systemd watchdog: %v", err)
+	}
+	if interval > 0 {
+		if interval <= 2*tunnel.PingWriteInterval {
+			logrus.Warnf("systemd watchdog interval %s is shorter than two tunnel pings (%s), the agent may be restarted while healthy",
+				interval, 2*tunnel.PingWriteInterval)
+		}
+		logrus.Infof("Sending systemd watchdog pings, systemd expects one every %s", interval)
+		client.OnPong = func() {
+			if err := notifier.Watchdog(); err != nil {
+				logrus.Debug(err)
+			}
+		}
+	}
+
+	var ready sync.Once
+	client.OnChange = func(status tunnel.Status) {
+		if status.Connected {
+			ready.Do(func() {
+				if err := notifier.Ready(); err != nil {
+					logrus.Warn(err)
+				}
+			})
+		}
+		if err := notifier.Status(redact.String(systemdStatus(status))); err != nil {
+			logrus.Debug(err)
+		}
+	}
+
+	if err := notifier.Status("Connecting to " + client.URL); err != nil {
+		logrus.Warn(err)
+	}
+}
+
+func systemdStatus(status tunnel.Status) string {
+	switch {
+	case status.Connected && status.DrainingSince != nil:
+		return fmt.Sprintf("Draining, session %s to %s", status.SessionID, status.URL)
+	case status.Connected:
+		return fmt.Sprintf("Connected, session %s to %s", status.SessionID, status.URL)
+	case status.LastError != "":
+		return fmt.Sprintf("Reconnecting to %s: %s", status.URL, status.LastError)
+	}
+	return "Reconnecting to " + status.URL
+}
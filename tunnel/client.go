@@ -0,0 +1,281 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/agent/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errWrongMessageType = errors.New("wrong websocket message type")
+	errDraining         = errors.New("node is draining, new connections are refused until the agent is resumed")
+)
+
+const reconnectInterval = 5 * time.Second
+
+// Authorizer decides whether the server may open a connection to address.
+type Authorizer func(proto, address string) bool
+
+// Client keeps a tunnel session to the server open, reconnecting when it drops.
+type Client struct {
+	URL        string
+	Headers    http.Header
+	TLSConfig  *tls.Config
+	Authorizer Authorizer
+	// TracePayloads logs the data written to the server at debug level. The
+	// payloads are redacted but may still contain sensitive data.
+	TracePayloads bool
+	// Rewrites map destinations the server asks for to local ones, before
+	// they are authorized and dialed.
+	Rewrites []Rewrite
+	// Interceptors may serve destinations within the agent, after they are
+	// authorized, instead of dialing them.
+	Interceptors []Interceptor
+	// Dial bounds the connections the server opens, zero values use defaults.
+	Dial DialOptions
+	// OnChange, if set, is called with the new status whenever the tunnel
+	// connects, disconnects, drains or resumes.
+	OnChange func(Status)
+	// OnPong, if set, is called whenever the server answers a ping.
+	OnPong func()
+	// OnRejected, if set, is called with the headers the server refused to
+	// connect with, answering 401 Unauthorized or 403 Forbidden, such as a
+	// revoked token.
+	OnRejected func(headers http.Header)
+
+	lock      sync.Mutex
+	draining  *time.Time
+	session   *session
+	sessions  int
+	status    Status
+	forced    bool
+	reconnect chan struct{}
+}
+
+// Status is a snapshot of the tunnel state.
+type Status struct {
+	URL       string `json:"url"`
+	Connected bool   `json:"connected"`
+	// Since is when the tunnel last connected or disconnected.
+	Since         time.Time  `json:"since"`
+	SessionID     string     `json:"sessionId,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	Reconnects    int        `json:"reconnects"`
+	Connections   int        `json:"connections"`
+	// DrainingSince is set while new connections are refused.
+	DrainingSince *time.Time `json:"drainingSince,omitempty"`
+}
+
+// Run connects to the server and serves tunneled connections. It never returns.
+func (c *Client) Run() {
+	dialer := &websocket.Dialer{
+		TLSClientConfig: c.TLSConfig,
+	}
+	wake := c.wakeup()
+
+	c.lock.Lock()
+	c.status.URL = c.URL
+	c.status.Since = time.Now()
+	c.lock.Unlock()
+
+	for {
+		err := c.connect(dialer)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to connect to proxy")
+		}
+
+		select {
+		case <-time.After(reconnectInterval):
+		case <-wake:
+		}
+	}
+}
+
+// Status returns the current state of the tunnel.
+func (c *Client) Status() Status {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	status := c.status
+	status.DrainingSince = c.draining
+	if c.session != nil {
+		status.Connections = c.session.connections()
+	}
+	return status
+}
+
+// Reconnect drops the current session, if any, and connects again immediately.
+func (c *Client) Reconnect() {
+	wake := c.wakeup()
+
+	c.lock.Lock()
+	if c.session != nil {
+		c.forced = true
+		c.session.conn.conn.Close()
+	}
+	c.lock.Unlock()
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Drain refuses new connections from the server while keeping the tunnel and
+// existing connections open.
+func (c *Client) Drain() {
+	c.lock.Lock()
+	changed := c.draining == nil
+	if changed {
+		now := time.Now()
+		c.draining = &now
+		logrus.Info("Draining, new connections will be refused")
+	}
+	c.lock.Unlock()
+
+	if changed {
+		c.changed()
+	}
+}
+
+// Resume accepts new connections again after Drain.
+func (c *Client) Resume() {
+	c.lock.Lock()
+	changed := c.draining != nil
+	if changed {
+		c.draining = nil
+		logrus.Info("Resumed, accepting new connections")
+	}
+	c.lock.Unlock()
+
+	if changed {
+		c.changed()
+	}
+}
+
+// SetHeaders replaces the headers sent on the next connect, such as when the
+// token changes. The current session is kept.
+func (c *Client) SetHeaders(headers http.Header) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Headers = headers
+}
+
+// Draining returns whether new connections are refused.
+func (c *Client) Draining() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.draining != nil
+}
+
+func (c *Client) wakeup() chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.reconnect == nil {
+		c.reconnect = make(chan struct{}, 1)
+	}
+	return c.reconnect
+}
+
+func (c *Client) connect(dialer *websocket.Dialer) error {
+	logrus.WithField("url", c.URL).Info("Connecting to proxy")
+
+	c.lock.Lock()
+	headers := c.Headers
+	c.lock.Unlock()
+
+	ws, resp, err := dialer.Dial(c.URL, headers)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v: %s", err, resp.Status)
+		}
+		c.disconnected(err)
+		c.changed()
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && c.OnRejected != nil {
+			c.OnRejected(headers)
+		}
+		return err
+	}
+	defer ws.Close()
+
+	id := newSessionID()
+	logging.SetField("session", id)
+	defer logging.SetField("session", "")
+
+	session := newSession(id, c, ws)
+	c.connected(session)
+	c.changed()
+
+	session.log.Info("Connected to proxy")
+	err = session.serve()
+	session.Close()
+
+	forced := c.disconnected(err)
+	c.changed()
+	if forced {
+		session.log.Info("Reconnect requested, disconnected from proxy")
+		return nil
+	}
+	return err
+}
+
+func (c *Client) changed() {
+	if c.OnChange != nil {
+		c.OnChange(c.Status())
+	}
+}
+
+func (c *Client) connected(session *session) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.sessions > 0 {
+		c.status.Reconnects++
+	}
+	c.sessions++
+	c.session = session
+	c.forced = false
+	c.status.Connected = true
+	c.status.Since = time.Now()
+	c.status.SessionID = session.id
+}
+
+// disconnected records err and returns whether the disconnect was requested
+// through Reconnect.
+func (c *Client) disconnected(err error) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	forced := c.forced
+	c.forced = false
+
+	if c.status.Connected {
+		c.status.Since = time.Now()
+	}
+	c.session = nil
+	c.status.Connected = false
+	c.status.SessionID = ""
+	if err != nil && !forced {
+		now := time.Now()
+		c.status.LastError = err.Error()
+		c.status.LastErrorTime = &now
+	}
+	return forced
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
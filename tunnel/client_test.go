@@ -0,0 +1,361 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/agent/redact"
+	"github.com/rancher/rancher/pkg/remotedialer"
+	"github.com/sirupsen/logrus"
+)
+
+const clientKey = "node1"
+
+type testServer struct {
+	*remotedialer.Server
+	http *httptest.Server
+	echo net.Listener
+}
+
+// newTestServer starts the vendored remotedialer server, which the forked
+// client must stay compatible with, and an echo server to dial through it.
+// revokedToken is refused by the test server.
+const revokedToken = "revoked"
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	server := remotedialer.New(func(req *http.Request) (string, bool, error) {
+		return clientKey, req.Header.Get("X-API-Tunnel-Token") != revokedToken, nil
+	}, func(rw http.ResponseWriter, req *http.Request, code int, err error) {
+		rw.WriteHeader(code)
+	}, func() bool {
+		return true
+	})
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	return &testServer{
+		Server: server,
+		http:   httptest.NewServer(server),
+		echo:   echo,
+	}
+}
+
+func (s *testServer) Close() {
+	s.http.Close()
+	s.echo.Close()
+}
+
+func (s *testServer) client(auth Authorizer) *Client {
+	return &Client{
+		URL:        strings.Replace(s.http.URL, "http", "ws", 1) + "/v3/connect",
+		Authorizer: auth,
+	}
+}
+
+func allowTCP(proto, address string) bool {
+	return proto == "tcp"
+}
+
+// waitConnected waits until the client has connected sessions times.
+func waitConnected(t *testing.T, client *Client, sessions int) Status {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		status := client.Status()
+		if status.Connected && status.Reconnects == sessions-1 {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("client did not connect, status %+v", client.Status())
+	return Status{}
+}
+
+// roundTrip writes data to conn and expects it back from the echo server.
+// The tunnel doesn't propagate half-closes, so reads have a deadline.
+func roundTrip(conn net.Conn, data string) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(data)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != data {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	client := server.client(allowTCP)
+	go client.Run()
+	waitConnected(t, client, 1)
+
+	conn, err := server.Dial(clientKey, 5*time.Second, "tcp", server.echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, data := range []string{"one", "two", strings.Repeat("x", 100000)} {
+		if err := roundTrip(conn, data); err != nil {
+			t.Fatalf("round trip of %d bytes: %v", len(data), err)
+		}
+	}
+	if connections := client.Status().Connections; connections != 1 {
+		t.Errorf("status shows %d connections, expected 1", connections)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	var changes []Status
+	client := server.client(allowTCP)
+	client.OnChange = func(status Status) {
+		changes = append(changes, status)
+	}
+	go client.Run()
+	waitConnected(t, client, 1)
+
+	existing, err := server.Dial(clientKey, 5*time.Second, "tcp", server.echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existing.Close()
+	// Server.Dial returns before the agent has seen the connect, so make
+	// sure the connection is established before draining.
+	if err := roundTrip(existing, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Drain()
+	if !client.Draining() || client.Status().DrainingSince == nil {
+		t.Fatal("client is not draining")
+	}
+
+	refused, err := server.Dial(clientKey, 5*time.Second, "tcp", server.echo.Addr().String())
+	if err == nil {
+		if err := roundTrip(refused, "refused"); err == nil {
+			t.Error("new connection was served while draining")
+		}
+		refused.Close()
+	}
+	if err := roundTrip(existing, "existing"); err != nil {
+		t.Errorf("existing connection broke while draining: %v", err)
+	}
+
+	client.Resume()
+	resumed, err := server.Dial(clientKey, 5*time.Second, "tcp", server.echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if err := roundTrip(resumed, "resumed"); err != nil {
+		t.Errorf("new connection failed after resume: %v", err)
+	}
+
+	if len(changes) < 3 || changes[len(changes)-2].DrainingSince == nil || changes[len(changes)-1].DrainingSince != nil {
+		t.Errorf("OnChange was not called for drain and resume: %+v", changes)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	client := server.client(allowTCP)
+	go client.Run()
+	first := waitConnected(t, client, 1)
+
+	client.Reconnect()
+	second := waitConnected(t, client, 2)
+	if second.SessionID == first.SessionID {
+		t.Error("reconnect kept the session")
+	}
+	if second.LastError != "" {
+		t.Errorf("requested reconnect recorded an error: %s", second.LastError)
+	}
+
+	conn, err := server.Dial(clientKey, 5*time.Second, "tcp", server.echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := roundTrip(conn, "after reconnect"); err != nil {
+		t.Errorf("round trip after reconnect: %v", err)
+	}
+}
+
+func TestAuthorizerRefuses(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	allowed := server.echo.Addr().String()
+	client := server.client(func(proto, address string) bool {
+		return proto == "tcp" && address == allowed
+	})
+	go client.Run()
+	waitConnected(t, client, 1)
+
+	// As with remotedialer, a refused connect drops the session.
+	conn, err := server.Dial(clientKey, 5*time.Second, "unix", "/var/run/docker.sock")
+	if err == nil {
+		if err := roundTrip(conn, "refused"); err == nil {
+			t.Error("refused connection was served")
+		}
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Status().LastError == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := client.Status(); !strings.Contains(status.LastError, "connect not allowed") {
+		t.Errorf("refusal is not the last error: %+v", status)
+	}
+}
+
+func TestListenerIntercepts(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	listener := NewListener("tcp", "echo."+AgentDomain+":80")
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	client := server.client(allowTCP)
+	client.Interceptors = []Interceptor{listener.Intercept}
+	go client.Run()
+	waitConnected(t, client, 1)
+
+	conn, err := server.Dial(clientKey, 5*time.Second, "tcp", "echo."+AgentDomain+":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := roundTrip(conn, "intercepted"); err != nil {
+		t.Errorf("round trip to the listener: %v", err)
+	}
+}
+
+func TestRejectedHeaders(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	rejected := make(chan http.Header, 10)
+	client := server.client(allowTCP)
+	client.Headers = http.Header{"X-API-Tunnel-Token": {revokedToken}}
+	client.OnRejected = func(headers http.Header) {
+		rejected <- headers
+	}
+	go client.Run()
+
+	select {
+	case headers := <-rejected:
+		if token := headers["X-API-Tunnel-Token"]; len(token) != 1 || token[0] != revokedToken {
+			t.Errorf("rejected headers carry token %v", token)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("OnRejected was not called, status %+v", client.Status())
+	}
+	if status := client.Status(); !strings.Contains(status.LastError, "401") {
+		t.Errorf("the refusal is not the last error: %+v", status)
+	}
+
+	client.SetHeaders(http.Header{"X-API-Tunnel-Token": {"valid"}})
+	client.Reconnect()
+	waitConnected(t, client, 1)
+}
+
+// payloadHook records the payloads the tunnel traces.
+type payloadHook struct {
+	lock     sync.Mutex
+	payloads []string
+}
+
+func (h *payloadHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.DebugLevel}
+}
+
+func (h *payloadHook) Fire(entry *logrus.Entry) error {
+	if strings.HasPrefix(entry.Message, "PAYLOAD") {
+		h.lock.Lock()
+		h.payloads = append(h.payloads, entry.Message)
+		h.lock.Unlock()
+	}
+	return nil
+}
+
+func TestTracePayloadsRedacted(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	hook := &payloadHook{}
+	logrus.AddHook(hook)
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.DebugLevel)
+
+	client := server.client(allowTCP)
+	client.TracePayloads = true
+	go client.Run()
+	waitConnected(t, client, 1)
+
+	conn, err := server.Dial(clientKey, 5*time.Second, "tcp", server.echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := roundTrip(conn, `{"auth":"dXNlcjpwYXNzd29yZA==","password":"hunter2hunter2"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	if len(hook.payloads) == 0 {
+		t.Fatal("no payload was traced")
+	}
+	for _, payload := range hook.payloads {
+		if strings.Contains(payload, "dXNlcjpwYXNzd29yZA==") || strings.Contains(payload, "hunter2hunter2") {
+			t.Errorf("payload is traced in plaintext: %s", payload)
+		}
+		if !strings.Contains(payload, redact.Mask) {
+			t.Errorf("payload is not redacted: %s", payload)
+		}
+	}
+}
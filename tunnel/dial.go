@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultDialTimeout    = 30 * time.Second
+	DefaultMaxDialTimeout = 2 * time.Minute
+	DefaultKeepAlive      = 30 * time.Second
+)
+
+var errIdleTimeout = errors.New("idle timeout")
+
+// DialOptions bound the connections the server opens through the tunnel.
+type DialOptions struct {
+	// Timeout is used when the server doesn't set a deadline.
+	Timeout time.Duration
+	// MaxTimeout caps the deadline set by the server.
+	MaxTimeout time.Duration
+	// KeepAlive is the TCP keepalive period, negative disables keepalives.
+	KeepAlive time.Duration
+	// IdleTimeout closes connections without traffic in either direction for
+	// that long, zero never closes them.
+	IdleTimeout time.Duration
+	// Source is the local address of TCP dials, nil lets the kernel pick.
+	Source net.IP
+	// SourceRules override Source for destinations in their network.
+	SourceRules []SourceRule
+}
+
+func (o DialOptions) withDefaults() DialOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultDialTimeout
+	}
+	if o.MaxTimeout <= 0 {
+		o.MaxTimeout = DefaultMaxDialTimeout
+	}
+	if o.Timeout > o.MaxTimeout {
+		o.Timeout = o.MaxTimeout
+	}
+	if o.KeepAlive == 0 {
+		o.KeepAlive = DefaultKeepAlive
+	}
+	return o
+}
+
+// timeout is the dial timeout for a deadline in milliseconds set by the server.
+func (o DialOptions) timeout(deadline int64) time.Duration {
+	if deadline <= 0 {
+		return o.Timeout
+	}
+	timeout := time.Duration(deadline) * time.Millisecond
+	if timeout > o.MaxTimeout {
+		return o.MaxTimeout
+	}
+	return timeout
+}
+
+func clientDial(conn *connection, message *message) {
+	defer conn.Close()
+
+	netConn, err := conn.session.intercept(message)
+	if netConn == nil && err == nil {
+		netConn, err = dial(conn.session.dial, message.proto, message.address, message.deadline)
+	}
+	if err != nil {
+		conn.log.WithError(err).Debugf("Failed to dial %s/%s", message.proto, message.address)
+		conn.tunnelClose(err)
+		return
+	}
+	defer netConn.Close()
+
+	pipe(conn, netConn, conn.session.dial.IdleTimeout)
+}
+
+func dial(opts DialOptions, proto, address string, deadline int64) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout(deadline))
+	defer cancel()
+
+	dialer := &net.Dialer{
+		KeepAlive: opts.KeepAlive,
+	}
+
+	if proto == "tcp" {
+		targets, err := opts.targets(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		return dialTargets(ctx, dialer, targets)
+	}
+
+	return dialer.DialContext(ctx, proto, address)
+}
+
+// dialTargets tries targets in order, splitting the remaining time between
+// them like net.Dialer does for the addresses of a host, and returns the first
+// error if none can be reached.
+func dialTargets(ctx context.Context, dialer *net.Dialer, targets []target) (net.Conn, error) {
+	var firstErr error
+	for i, t := range targets {
+		attemptCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok && i < len(targets)-1 {
+			var cancel context.CancelFunc
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(targets)-i))
+			defer cancel()
+		}
+
+		dialer.LocalAddr = nil
+		if t.source != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: t.source}
+		}
+		conn, err := dialer.DialContext(attemptCtx, "tcp", t.address)
+		if err == nil {
+			return conn, nil
+		}
+		if opErr, ok := err.(*net.OpError); ok && t.source != nil {
+			// Keep it short, the server only reads 100 bytes of errors.
+			err = fmt.Errorf("dial %s from %s: %v", t.address, t.source, opErr.Err)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+func pipe(client *connection, server net.Conn, idleTimeout time.Duration) {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	var (
+		from io.Reader = client
+		to   io.Reader = server
+		idle *idleTimer
+	)
+	if idleTimeout > 0 {
+		idle = newIdleTimer(idleTimeout, func() {
+			client.log.Debugf("Closing connection to %s/%s, idle for %s", client.addr.proto, client.addr.address, idleTimeout)
+			client.tunnelClose(errIdleTimeout)
+			server.Close()
+		})
+		defer idle.stop()
+		from = idle.reader(from)
+		to = idle.reader(to)
+	}
+
+	go func() error {
+		defer wg.Done()
+		_, err := io.Copy(server, from)
+		if err != nil {
+			client.tunnelClose(err)
+			server.Close()
+		}
+		return err
+	}()
+
+	_, err := io.Copy(client, to)
+	if err != nil {
+		client.tunnelClose(err)
+		server.Close()
+		if idle == nil || !idle.expired() {
+			client.log.WithError(err).Error("client connection failed")
+		}
+	}
+
+	wg.Wait()
+}
+
+// idleTimer calls expire once no reader saw data for timeout.
+type idleTimer struct {
+	timeout time.Duration
+	last    int64
+	done    int32
+	timer   *time.Timer
+	expire  func()
+}
+
+func newIdleTimer(timeout time.Duration, expire func()) *idleTimer {
+	i := &idleTimer{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+		expire:  expire,
+	}
+	i.timer = time.AfterFunc(timeout, i.check)
+	return i
+}
+
+func (i *idleTimer) check() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&i.last)))
+	if idle < i.timeout {
+		i.timer.Reset(i.timeout - idle)
+		return
+	}
+	atomic.StoreInt32(&i.done, 1)
+	i.expire()
+}
+
+func (i *idleTimer) expired() bool {
+	return atomic.LoadInt32(&i.done) == 1
+}
+
+func (i *idleTimer) stop() {
+	i.timer.Stop()
+}
+
+func (i *idleTimer) reader(r io.Reader) io.Reader {
+	return idleReader{Reader: r, timer: i}
+}
+
+type idleReader struct {
+	io.Reader
+	timer *idleTimer
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&r.timer.last, time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDialOptionsDefaults(t *testing.T) {
+	for _, test := range []struct {
+		opts                DialOptions
+		timeout, maxTimeout time.Duration
+		keepAlive           time.Duration
+	}{
+		{DialOptions{}, DefaultDialTimeout, DefaultMaxDialTimeout, DefaultKeepAlive},
+		{DialOptions{Timeout: 5 * time.Second, KeepAlive: -1}, 5 * time.Second, DefaultMaxDialTimeout, -1},
+		{DialOptions{Timeout: 5 * time.Minute}, DefaultMaxDialTimeout, DefaultMaxDialTimeout, DefaultKeepAlive},
+		{DialOptions{Timeout: time.Minute, MaxTimeout: 10 * time.Second}, 10 * time.Second, 10 * time.Second, DefaultKeepAlive},
+		{DialOptions{MaxTimeout: 5 * time.Minute}, DefaultDialTimeout, 5 * time.Minute, DefaultKeepAlive},
+	} {
+		opts := test.opts.withDefaults()
+		if opts.Timeout != test.timeout || opts.MaxTimeout != test.maxTimeout || opts.KeepAlive != test.keepAlive {
+			t.Errorf("%+v has defaults %+v", test.opts, opts)
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	opts := DialOptions{}.withDefaults()
+	for deadline, expected := range map[int64]time.Duration{
+		0:       DefaultDialTimeout,
+		-1:      DefaultDialTimeout,
+		1500:    1500 * time.Millisecond,
+		120000:  2 * time.Minute,
+		3600000: DefaultMaxDialTimeout,
+		1 << 40: DefaultMaxDialTimeout,
+	} {
+		if timeout := opts.timeout(deadline); timeout != expected {
+			t.Errorf("deadline %dms: timeout is %s, expected %s", deadline, timeout, expected)
+		}
+	}
+}
+
+// slowReader returns a byte every interval.
+type slowReader struct {
+	interval time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.interval)
+	return copy(p, "x"), nil
+}
+
+func TestIdleTimer(t *testing.T) {
+	var expired int32
+	idle := newIdleTimer(100*time.Millisecond, func() {
+		atomic.AddInt32(&expired, 1)
+	})
+	defer idle.stop()
+
+	// Reads on either side keep the timer from expiring.
+	reader := idle.reader(slowReader{interval: 30 * time.Millisecond})
+	start := time.Now()
+	for time.Since(start) < 300*time.Millisecond {
+		if _, err := reader.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if idle.expired() || atomic.LoadInt32(&expired) != 0 {
+		t.Fatal("timer expired while data was read")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if !idle.expired() || atomic.LoadInt32(&expired) != 1 {
+		t.Errorf("timer expired %d times without reads, expected once", atomic.LoadInt32(&expired))
+	}
+}
+
+func TestIdleTimeoutClosesConnection(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Close()
+
+	client := server.client(allowTCP)
+	client.Dial.IdleTimeout = 300 * time.Millisecond
+	go client.Run()
+	waitConnected(t, client, 1)
+
+	conn, err := server.Dial(clientKey, 5*time.Second, "tcp", server.echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Traffic for longer than the timeout keeps the connection open.
+	for i := 0; i < 5; i++ {
+		if err := roundTrip(conn, "ping"); err != nil {
+			t.Fatalf("round trip %d: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err == nil {
+		t.Fatal("read from an idle connection succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle connection was closed after %s", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Status().Connections != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if connections := client.Status().Connections; connections != 0 {
+		t.Errorf("status shows %d connections after the idle timeout", connections)
+	}
+}
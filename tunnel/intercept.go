@@ -0,0 +1,36 @@
+package tunnel
+
+import "net"
+
+// AgentDomain is reserved for services the agent serves itself through the
+// tunnel. Names under .invalid never resolve, so they can't shadow a real
+// destination.
+const AgentDomain = "agent.cattle.invalid"
+
+// Destination is a connection the server asked for, after rewrites.
+type Destination struct {
+	Session    string
+	Connection int64
+	Proto      string
+	Address    string
+}
+
+// Interceptor serves a destination within the agent instead of dialing it. It
+// returns a nil net.Conn and error for destinations it doesn't handle.
+type Interceptor func(Destination) (net.Conn, error)
+
+func (s *session) intercept(message *message) (net.Conn, error) {
+	dest := Destination{
+		Session:    s.id,
+		Connection: message.connID,
+		Proto:      message.proto,
+		Address:    message.address,
+	}
+	for _, interceptor := range s.interceptors {
+		conn, err := interceptor(dest)
+		if conn != nil || err != nil {
+			return conn, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// Listener hands the connections the server opens to one address to a server
+// in the agent, such as an http.Server, without listening on a port. Add its
+// Intercept method to the Client's Interceptors.
+type Listener struct {
+	proto   string
+	address string
+	conns   chan net.Conn
+	once    sync.Once
+	done    chan struct{}
+}
+
+// NewListener returns a Listener for connections to proto and address.
+func NewListener(proto, address string) *Listener {
+	return &Listener{
+		proto:   proto,
+		address: address,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+}
+
+// Intercept is an Interceptor passing connections to the address to Accept.
+func (l *Listener) Intercept(dest Destination) (net.Conn, error) {
+	if dest.Proto != l.proto || dest.Address != l.address {
+		return nil, nil
+	}
+
+	tunnelEnd, serverEnd := net.Pipe()
+	select {
+	case l.conns <- serverEnd:
+		return tunnelEnd, nil
+	case <-l.done:
+		tunnelEnd.Close()
+		serverEnd.Close()
+		return nil, errListenerClosed
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return addr{proto: l.proto, address: l.address}
+}
@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rewrite maps a destination the server asks for to the local one it dials.
+type Rewrite struct {
+	FromProto string
+	From      string
+	ToProto   string
+	To        string
+}
+
+// ParseRewrites parses comma separated proto:address=[proto:]address rules,
+// such as unix:/var/run/docker.sock=/run/user/1000/docker.sock or
+// tcp:kubelet:10250=tcp:127.0.0.1:10250. The target keeps the proto of the
+// destination unless it has one.
+func ParseRewrites(value string) ([]Rewrite, error) {
+	var rewrites []Rewrite
+	seen := map[string]bool{}
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rewrite %q, must be proto:address=[proto:]address", rule)
+		}
+
+		fromProto, from, ok := splitProto(strings.TrimSpace(parts[0]))
+		if !ok || from == "" {
+			return nil, fmt.Errorf("invalid rewrite %q, the destination must start with tcp: or unix:", rule)
+		}
+		toProto, to, ok := splitProto(strings.TrimSpace(parts[1]))
+		if !ok {
+			toProto, to = fromProto, strings.TrimSpace(parts[1])
+		}
+		if to == "" {
+			return nil, fmt.Errorf("invalid rewrite %q, the target is empty", rule)
+		}
+
+		key := fromProto + "/" + from
+		if seen[key] {
+			return nil, fmt.Errorf("invalid rewrite %q, %s/%s is rewritten twice", rule, fromProto, from)
+		}
+		seen[key] = true
+
+		rewrites = append(rewrites, Rewrite{
+			FromProto: fromProto,
+			From:      from,
+			ToProto:   toProto,
+			To:        to,
+		})
+	}
+	return rewrites, nil
+}
+
+func splitProto(value string) (string, string, bool) {
+	for _, proto := range []string{"tcp", "unix"} {
+		if strings.HasPrefix(value, proto+":") {
+			return proto, strings.TrimPrefix(value, proto+":"), true
+		}
+	}
+	return "", value, false
+}
+
+// rewrite returns the local destination for proto and address.
+func rewrite(rewrites []Rewrite, proto, address string) (string, string, bool) {
+	for _, r := range rewrites {
+		if r.FromProto == proto && r.From == address {
+			return r.ToProto, r.To, true
+		}
+	}
+	return proto, address, false
+}
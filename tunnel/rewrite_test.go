@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRewrites(t *testing.T) {
+	rewrites, err := ParseRewrites(" unix:/var/run/docker.sock=/run/user/1000/docker.sock, ,tcp:kubelet:10250=tcp:127.0.0.1:10250,tcp:127.0.0.1:2375 = unix:/var/run/docker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Rewrite{
+		{FromProto: "unix", From: "/var/run/docker.sock", ToProto: "unix", To: "/run/user/1000/docker.sock"},
+		{FromProto: "tcp", From: "kubelet:10250", ToProto: "tcp", To: "127.0.0.1:10250"},
+		{FromProto: "tcp", From: "127.0.0.1:2375", ToProto: "unix", To: "/var/run/docker.sock"},
+	}
+	if len(rewrites) != len(expected) {
+		t.Fatalf("parsed %+v, expected %+v", rewrites, expected)
+	}
+	for i := range expected {
+		if rewrites[i] != expected[i] {
+			t.Errorf("rewrite %d is %+v, expected %+v", i, rewrites[i], expected[i])
+		}
+	}
+
+	if rewrites, err := ParseRewrites(""); err != nil || len(rewrites) != 0 {
+		t.Errorf("empty rewrites parsed as %+v, %v", rewrites, err)
+	}
+}
+
+func TestParseRewritesInvalid(t *testing.T) {
+	for value, expected := range map[string]string{
+		"unix:/var/run/docker.sock":                                 "must be proto:address=[proto:]address",
+		"/var/run/docker.sock=/run/docker.sock":                     "must start with tcp: or unix:",
+		"udp:dns:53=tcp:127.0.0.1:53":                               "must start with tcp: or unix:",
+		"tcp:=tcp:127.0.0.1:80":                                     "must start with tcp: or unix:",
+		"tcp:kubelet:10250=":                                        "the target is empty",
+		"tcp:kubelet:10250=tcp:":                                    "the target is empty",
+		"tcp:a:1=tcp:b:1,unix:/x=/y,tcp:a:1=tcp:c:1":                "tcp/a:1 is rewritten twice",
+		"unix:/var/run/docker.sock=/a,unix:/var/run/docker.sock=/b": "unix//var/run/docker.sock is rewritten twice",
+	} {
+		rewrites, err := ParseRewrites(value)
+		if err == nil {
+			t.Errorf("%q parsed as %+v", value, rewrites)
+		} else if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: %q does not contain %q", value, err, expected)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	rewrites := []Rewrite{
+		{FromProto: "unix", From: "/var/run/docker.sock", ToProto: "unix", To: "/run/user/1000/docker.sock"},
+		{FromProto: "tcp", From: "127.0.0.1:2375", ToProto: "unix", To: "/var/run/docker.sock"},
+	}
+	for _, test := range []struct {
+		proto, address string
+		toProto, to    string
+		rewritten      bool
+	}{
+		{"unix", "/var/run/docker.sock", "unix", "/run/user/1000/docker.sock", true},
+		{"tcp", "127.0.0.1:2375", "unix", "/var/run/docker.sock", true},
+		// Only the exact proto and address match, rewrites don't chain.
+		{"tcp", "/var/run/docker.sock", "tcp", "/var/run/docker.sock", false},
+		{"tcp", "localhost:2375", "tcp", "localhost:2375", false},
+		{"unix", "/var/run/docker.sock/", "unix", "/var/run/docker.sock/", false},
+	} {
+		proto, address, rewritten := rewrite(rewrites, test.proto, test.address)
+		if proto != test.toProto || address != test.to || rewritten != test.rewritten {
+			t.Errorf("%s/%s rewritten to %s/%s (%v), expected %s/%s (%v)",
+				test.proto, test.address, proto, address, rewritten, test.toProto, test.to, test.rewritten)
+		}
+	}
+
+	if proto, address, rewritten := rewrite(nil, "tcp", "10.0.0.1:80"); rewritten || proto != "tcp" || address != "10.0.0.1:80" {
+		t.Errorf("rewritten without rules to %s/%s", proto, address)
+	}
+}
@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rancher/agent/audit"
+	"github.com/rancher/agent/redact"
+	"github.com/sirupsen/logrus"
+)
+
+type session struct {
+	sync.Mutex
+
+	id           string
+	conn         *wsConn
+	conns        map[int64]*connection
+	auth         Authorizer
+	trace        bool
+	dial         DialOptions
+	rewrites     []Rewrite
+	interceptors []Interceptor
+	draining     func() bool
+	pingCancel   context.CancelFunc
+	pingWait     sync.WaitGroup
+	log          *logrus.Entry
+}
+
+func newSession(id string, client *Client, conn *websocket.Conn) *session {
+	return &session{
+		id:           id,
+		conn:         newWSConn(conn, client.OnPong),
+		conns:        map[int64]*connection{},
+		auth:         client.Authorizer,
+		trace:        client.TracePayloads,
+		dial:         client.Dial.withDefaults(),
+		rewrites:     client.Rewrites,
+		interceptors: client.Interceptors,
+		draining:     client.Draining,
+		log:          logrus.WithField("session", id),
+	}
+}
+
+func (s *session) startPings() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.pingCancel = cancel
+	s.pingWait.Add(1)
+
+	go func() {
+		defer s.pingWait.Done()
+
+		t := time.NewTicker(PingWriteInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				s.conn.Lock()
+				if err := s.conn.conn.WriteControl(websocket.PingMessage, []byte(""), time.Now().Add(time.Second)); err != nil {
+					s.log.WithError(err).Error("Error writing ping")
+				}
+				s.log.Debug("Wrote ping")
+				s.conn.Unlock()
+			}
+		}
+	}()
+}
+
+func (s *session) stopPings() {
+	if s.pingCancel == nil {
+		return
+	}
+
+	s.pingCancel()
+	s.pingWait.Wait()
+}
+
+func (s *session) serve() error {
+	s.startPings()
+
+	for {
+		msType, reader, err := s.conn.NextReader()
+		if err != nil {
+			return err
+		}
+
+		if msType != websocket.BinaryMessage {
+			return errWrongMessageType
+		}
+
+		if err := s.serveMessage(reader); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) serveMessage(reader io.Reader) error {
+	message, err := newServerMessage(reader)
+	if err != nil {
+		return err
+	}
+
+	log := s.log.WithField("connection", message.connID)
+	log.Debug("REQUEST ", message)
+
+	if message.messageType == Connect {
+		event := audit.Event{
+			Session:    s.id,
+			Connection: message.connID,
+			Proto:      message.proto,
+			Address:    message.address,
+		}
+		if proto, address, ok := rewrite(s.rewrites, message.proto, message.address); ok {
+			log.Debugf("Rewriting %s/%s to %s/%s", message.proto, message.address, proto, address)
+			message.proto, message.address = proto, address
+			event.Target = proto + "/" + address
+		}
+
+		if s.auth == nil || !s.auth(message.proto, message.address) {
+			event.Reason = "not authorized"
+			audit.Record(event)
+			return errors.New("connect not allowed")
+		}
+		if s.draining() {
+			event.Reason = "draining"
+			audit.Record(event)
+			log.Infof("Refusing connection to %s/%s, agent is draining", message.proto, message.address)
+			_, err := s.writeMessage(newErrorMessage(message.connID, errDraining))
+			return err
+		}
+
+		event.Allowed = true
+		audit.Record(event)
+		s.clientConnect(message)
+		return nil
+	}
+
+	s.Lock()
+	conn := s.conns[message.connID]
+	s.Unlock()
+
+	if conn == nil {
+		if message.messageType == Data {
+			err := fmt.Errorf("connection not found %s/%d", s.id, message.connID)
+			newErrorMessage(message.connID, err).WriteTo(s.conn)
+		}
+		return nil
+	}
+
+	switch message.messageType {
+	case Data:
+		if _, err := io.Copy(conn.tunnelWriter(), message); err != nil {
+			s.closeConnection(message.connID, err)
+		}
+	case Error:
+		s.closeConnection(message.connID, message.Err())
+	}
+
+	return nil
+}
+
+func (s *session) closeConnection(connID int64, err error) {
+	s.Lock()
+	conn := s.conns[connID]
+	delete(s.conns, connID)
+	s.log.WithField("connection", connID).Debugf("CONNECTIONS %d", len(s.conns))
+	s.Unlock()
+
+	if conn != nil {
+		conn.tunnelClose(err)
+	}
+}
+
+func (s *session) clientConnect(message *message) {
+	conn := newConnection(message.connID, s, message.proto, message.address)
+
+	s.Lock()
+	s.conns[message.connID] = conn
+	conn.log.Debugf("CONNECTIONS %d", len(s.conns))
+	s.Unlock()
+
+	go clientDial(conn, message)
+}
+
+func (s *session) writeMessage(message *message) (int, error) {
+	log := s.log.WithField("connection", message.connID)
+	log.Debug("RESPONSE ", message)
+	if s.trace && message.messageType == Data {
+		// Redacted before quoting, quoted JSON no longer matches the patterns.
+		log.Debugf("PAYLOAD %d: %q", message.id, redact.String(string(message.bytes)))
+	}
+	return message.WriteTo(s.conn)
+}
+
+func (s *session) connections() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.conns)
+}
+
+func (s *session) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.stopPings()
+
+	for _, connection := range s.conns {
+		connection.tunnelClose(errors.New("tunnel disconnect"))
+	}
+
+	s.conns = map[int64]*connection{}
+}
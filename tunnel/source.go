@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// SourceAuto lets the kernel pick the source address.
+	SourceAuto = "auto"
+	// SourceInternal binds to the internal address of the node.
+	SourceInternal = "internal"
+)
+
+// SourceRule binds dials to destinations in Network to Address, nil lets the
+// kernel pick.
+type SourceRule struct {
+	Network *net.IPNet
+	Address net.IP
+}
+
+// ParseSourceAddress parses an IP, SourceInternal for internal, or SourceAuto
+// or empty for none.
+func ParseSourceAddress(value, internal string) (net.IP, error) {
+	switch value {
+	case "", SourceAuto:
+		return nil, nil
+	case SourceInternal:
+		if internal == "" {
+			return nil, fmt.Errorf("source address %q requires an internal address", SourceInternal)
+		}
+		value = internal
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address %q, must be an IP, %s or %s", value, SourceInternal, SourceAuto)
+	}
+	return ip, nil
+}
+
+// ParseSourceRules parses comma separated CIDR=address rules, where address is
+// anything ParseSourceAddress accepts.
+func ParseSourceRules(value, internal string) ([]SourceRule, error) {
+	var rules []SourceRule
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid source address rule %q, must be CIDR=address", rule)
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address rule %q: %v", rule, err)
+		}
+		address, err := ParseSourceAddress(strings.TrimSpace(parts[1]), internal)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address rule %q: %v", rule, err)
+		}
+		rules = append(rules, SourceRule{Network: network, Address: address})
+	}
+	return rules, nil
+}
+
+// target is a resolved TCP address and the local address to dial it from.
+type target struct {
+	source  net.IP
+	address string
+}
+
+// targets returns the addresses to try in order when dialing the TCP address.
+// A host name is resolved to match the rules, and the addresses in the same
+// family as their source come first, so a rule binding to an IPv4 address
+// isn't defeated by the resolver returning an IPv6 address first.
+func (o DialOptions) targets(ctx context.Context, address string) ([]target, error) {
+	if len(o.SourceRules) == 0 {
+		return []target{{source: o.Source, address: address}}, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips = ips[:0]
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return o.targetsFor(ips, port), nil
+}
+
+func (o DialOptions) targetsFor(ips []net.IP, port string) []target {
+	var targets, others []target
+	for _, ip := range ips {
+		t := target{source: o.sourceFor(ip), address: net.JoinHostPort(ip.String(), port)}
+		if t.source == nil || sameFamily(t.source, ip) {
+			targets = append(targets, t)
+		} else {
+			others = append(others, t)
+		}
+	}
+	return append(targets, others...)
+}
+
+// sourceFor returns the source of the most specific rule matching ip.
+func (o DialOptions) sourceFor(ip net.IP) net.IP {
+	var match *SourceRule
+	for i, rule := range o.SourceRules {
+		if !rule.Network.Contains(ip) {
+			continue
+		}
+		if match == nil || prefixLength(rule.Network) > prefixLength(match.Network) {
+			match = &o.SourceRules[i]
+		}
+	}
+	if match != nil {
+		return match.Address
+	}
+	return o.Source
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+func prefixLength(network *net.IPNet) int {
+	ones, _ := network.Mask.Size()
+	return ones
+}
@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTargetsPreferSourceFamily(t *testing.T) {
+	rules, err := ParseSourceRules("10.0.0.0/8=10.1.1.1, 0.0.0.0/0=192.168.1.1, fd00::/8=fd00::1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		opts     DialOptions
+		ips      []string
+		expected []target
+	}{
+		{
+			name: "most specific rule",
+			opts: DialOptions{SourceRules: rules},
+			ips:  []string{"10.2.3.4"},
+			expected: []target{
+				{net.ParseIP("10.1.1.1"), "10.2.3.4:443"},
+			},
+		},
+		{
+			name: "IPv6 first, rule for IPv4",
+			opts: DialOptions{Source: net.ParseIP("192.168.1.1"), SourceRules: rules[:1]},
+			ips:  []string{"2001:db8::1", "10.2.3.4"},
+			expected: []target{
+				{net.ParseIP("10.1.1.1"), "10.2.3.4:443"},
+				{net.ParseIP("192.168.1.1"), "[2001:db8::1]:443"},
+			},
+		},
+		{
+			name: "kernel picks for unmatched",
+			opts: DialOptions{SourceRules: rules[2:]},
+			ips:  []string{"10.2.3.4", "fd00::2"},
+			expected: []target{
+				{nil, "10.2.3.4:443"},
+				{net.ParseIP("fd00::1"), "[fd00::2]:443"},
+			},
+		},
+		{
+			name: "resolver order kept when the families match",
+			opts: DialOptions{SourceRules: rules},
+			ips:  []string{"2001:db8::1", "10.2.3.4", "172.16.0.1", "fd00::2"},
+			expected: []target{
+				{nil, "[2001:db8::1]:443"},
+				{net.ParseIP("10.1.1.1"), "10.2.3.4:443"},
+				{net.ParseIP("192.168.1.1"), "172.16.0.1:443"},
+				{net.ParseIP("fd00::1"), "[fd00::2]:443"},
+			},
+		},
+	} {
+		var ips []net.IP
+		for _, ip := range test.ips {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		if targets := test.opts.targetsFor(ips, "443"); !reflect.DeepEqual(targets, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, targets, test.expected)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package tunnel
+
+import (
+	"time"
+)
+
+var (
+	PingWaitDuration  = time.Duration(10 * time.Second)
+	PingWriteInterval = time.Duration(5 * time.Second)
+)
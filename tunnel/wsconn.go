@@ -0,0 +1,51 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsConn struct {
+	sync.Mutex
+	conn   *websocket.Conn
+	onPong func()
+}
+
+func newWSConn(conn *websocket.Conn, onPong func()) *wsConn {
+	w := &wsConn{
+		conn:   conn,
+		onPong: onPong,
+	}
+	w.setupDeadline()
+	return w
+}
+
+func (w *wsConn) WriteMessage(messageType int, data []byte) error {
+	w.Lock()
+	defer w.Unlock()
+	return w.conn.WriteMessage(messageType, data)
+}
+
+func (w *wsConn) NextReader() (int, io.Reader, error) {
+	return w.conn.NextReader()
+}
+
+func (w *wsConn) setupDeadline() {
+	w.conn.SetReadDeadline(time.Now().Add(PingWaitDuration))
+	w.conn.SetPingHandler(func(string) error {
+		w.Lock()
+		w.conn.WriteControl(websocket.PongMessage, []byte(""), time.Now().Add(time.Second))
+		w.Unlock()
+		return w.conn.SetReadDeadline(time.Now().Add(PingWaitDuration))
+	})
+	w.conn.SetPongHandler(func(string) error {
+		if w.onPong != nil {
+			w.onPong()
+		}
+		return w.conn.SetReadDeadline(time.Now().Add(PingWaitDuration))
+	})
+
+}